@@ -17,20 +17,20 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/rquitales/go-presentation-server/cmd/server"
+	serverPkg "github.com/rquitales/go-presentation-server/pkg/server"
 	"github.com/spf13/cobra"
 )
 
-var (
-	folder, addr string
-)
+var opts serverPkg.Options
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "present",
 	Short: "Start a simple fileserver with a websocket for code execution.",
-	Run:   server.Serve(&folder, &addr),
+	Run:   server.Serve(&opts),
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -43,7 +43,16 @@ func Execute() {
 }
 
 func init() {
-	rootCmd.Flags().StringVar(&folder, "folder", "", "path to folder containing static assets")
-	rootCmd.Flags().StringVar(&addr, "address", "localhost:8080", "the address to serve on")
+	rootCmd.Flags().StringVar(&opts.Folder, "folder", "", "path to folder containing static assets")
+	rootCmd.Flags().StringVar(&opts.Address, "address", "localhost:8080", "the address to serve on")
+	rootCmd.Flags().StringArrayVar(&opts.AllowedOrigins, "allowed-origin", nil, "additional origin allowed to open the websocket, eg: https://*.example.com (repeatable)")
+	rootCmd.Flags().StringVar(&opts.TokenFile, "token-file", "", "file containing the presenter token (defaults to $PRESENT_TOKEN, or a generated token)")
+	rootCmd.Flags().StringVar(&opts.PolicyFile, "policy", "", "path to a YAML execution policy restricting what presenters may run")
+	rootCmd.Flags().StringVar(&opts.GoCache, "go-cache", "", "directory for the Go build and module caches (defaults to a directory in the user cache directory)")
+	rootCmd.Flags().BoolVar(&opts.GoOffline, "go-offline", false, "build Go snippets without downloading modules")
+	rootCmd.Flags().StringVar(&opts.GoModules, "go-modules", "", "directory of modules laid out like a module proxy, used to build Go snippets offline")
+	rootCmd.Flags().StringVar(&opts.Record, "record", "", "directory to record the output of every snippet run to, for replaying offline")
+	rootCmd.Flags().StringVar(&opts.Replay, "replay", "", "directory of recordings to replay instead of running snippets")
+	rootCmd.Flags().DurationVar(&opts.ResumeGrace, "resume-grace", time.Minute, "how long snippets keep running after the presenter's connection drops, waiting for it to reconnect (0 kills them straight away)")
 	rootCmd.MarkFlagRequired("folder")
 }
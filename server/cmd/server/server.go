@@ -19,8 +19,8 @@ import (
 	"github.com/spf13/cobra"
 )
 
-func Serve(path, addr *string) func(*cobra.Command, []string) {
+func Serve(opts *serverPkg.Options) func(*cobra.Command, []string) {
 	return func(cmd *cobra.Command, args []string) {
-		serverPkg.Serve(*path, *addr)
+		serverPkg.Serve(*opts)
 	}
 }
@@ -14,8 +14,13 @@
 
 package main
 
-import "github.com/rquitales/go-presentation-server/cmd"
+import (
+	"github.com/rquitales/go-presentation-server/cmd"
+	"github.com/rquitales/go-presentation-server/pkg/sandbox"
+)
 
 func main() {
+	// Set up and exec sandboxed commands when re-executed as their init.
+	sandbox.Init()
 	cmd.Execute()
 }
@@ -0,0 +1,373 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package k8s applies, creates and deletes the objects of Kubernetes
+// manifests with client-go, reporting what happened to each one.
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+// FieldManager is the manager of the fields the server applies.
+const FieldManager = "present"
+
+// Actions taken on an object.
+const (
+	Created    = "created"
+	Configured = "configured"
+	Unchanged  = "unchanged"
+	Deleted    = "deleted"
+)
+
+// Result is what happened to an object of a manifest.
+type Result struct {
+	APIVersion string
+	Kind       string
+	Namespace  string `json:",omitempty"` // empty for cluster-scoped objects
+	Name       string
+	Action     string // "created", "configured", "unchanged" or "deleted"
+	DryRun     bool   `json:",omitempty"` // if the action would have been taken
+	Diff       string `json:",omitempty"` // of the live and applied objects, for diffs only
+}
+
+// String describes the result like kubectl does, eg:
+// "deployment.apps/nginx created".
+func (r *Result) String() string {
+	s := resourceName(r.APIVersion, r.Kind, r.Name) + " " + r.Action
+	if r.DryRun {
+		s += " (server dry run)"
+	}
+	return s
+}
+
+// resourceName returns the name kubectl gives an object, eg:
+// "deployment.apps/nginx".
+func resourceName(apiVersion, kind, name string) string {
+	s := strings.ToLower(kind)
+	if gv, err := schema.ParseGroupVersion(apiVersion); err == nil && gv.Group != "" {
+		s += "." + gv.Group
+	}
+	return s + "/" + name
+}
+
+// Describe returns the name kubectl gives obj, for error messages.
+func Describe(obj *unstructured.Unstructured) string {
+	return resourceName(obj.GetAPIVersion(), obj.GetKind(), obj.GetName())
+}
+
+// Client makes changes to a cluster, and watches it.
+type Client struct {
+	dyn       dynamic.Interface
+	cs        kubernetes.Interface // for what dyn can't do, eg: read logs
+	mapper    meta.RESTMapper
+	namespace string // for namespaced objects which don't set one
+}
+
+// NewClient returns a client using dyn and cs, which finds the resources
+// of kinds with mapper.
+func NewClient(dyn dynamic.Interface, cs kubernetes.Interface, mapper meta.RESTMapper, namespace string) *Client {
+	return &Client{dyn: dyn, cs: cs, mapper: mapper, namespace: namespace}
+}
+
+// Namespace returns the namespace of namespaced objects which don't set one,
+// or "default" for a nil client.
+func (c *Client) Namespace() string {
+	if c == nil {
+		return "default"
+	}
+	return c.namespace
+}
+
+// NewFromKubeconfig returns a client for the current context of the
+// kubeconfig, found like kubectl does, or for the cluster the server runs
+// in. The cluster is not contacted until the client is used.
+func NewFromKubeconfig() (*Client, error) {
+	cc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{})
+	cfg, err := cc.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	ns, _, err := cc.Namespace()
+	if err != nil {
+		return nil, err
+	}
+	dyn, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cs, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(cs.Discovery()))
+	return NewClient(dyn, cs, mapper, ns), nil
+}
+
+// Decode returns the objects of a manifest of YAML or JSON documents. The
+// items of lists are returned in their place.
+func Decode(manifest string) ([]*unstructured.Unstructured, error) {
+	dec := yaml.NewYAMLOrJSONDecoder(strings.NewReader(manifest), 4096)
+	var objs []*unstructured.Unstructured
+	for {
+		var raw map[string]interface{}
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(raw) == 0 {
+			continue // an empty document
+		}
+		obj := &unstructured.Unstructured{Object: raw}
+		if obj.GetKind() == "" || obj.GetAPIVersion() == "" {
+			return nil, fmt.Errorf("object %d has no kind or apiVersion", len(objs)+1)
+		}
+		if !obj.IsList() {
+			objs = append(objs, obj)
+			continue
+		}
+		err := obj.EachListItem(func(item runtime.Object) error {
+			objs = append(objs, item.(*unstructured.Unstructured))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(objs) == 0 {
+		return nil, errors.New("no objects found in manifest")
+	}
+	return objs, nil
+}
+
+// Do applies, creates or deletes obj, or reports what applying it would
+// do, as given by action: "apply", "create", "delete", "dryRun" or "diff".
+func (c *Client) Do(ctx context.Context, action string, obj *unstructured.Unstructured) (*Result, error) {
+	switch action {
+	case "apply":
+		return c.Apply(ctx, obj)
+	case "create":
+		return c.Create(ctx, obj)
+	case "delete":
+		return c.Delete(ctx, obj)
+	case "dryRun":
+		return c.DryRun(ctx, obj)
+	case "diff":
+		return c.Diff(ctx, obj)
+	}
+	return nil, fmt.Errorf("unknown action %q", action)
+}
+
+// Apply applies obj with server-side apply, taking ownership of fields
+// managed by others, like kubectl apply --server-side --force-conflicts.
+func (c *Client) Apply(ctx context.Context, obj *unstructured.Unstructured) (*Result, error) {
+	r, _, _, err := c.apply(ctx, obj, false)
+	return r, err
+}
+
+// DryRun reports what applying obj would do, without changing anything.
+func (c *Client) DryRun(ctx context.Context, obj *unstructured.Unstructured) (*Result, error) {
+	r, _, _, err := c.apply(ctx, obj, true)
+	return r, err
+}
+
+// Diff is like DryRun, also returning a unified diff of the live object
+// and the object applying obj would leave, as Result.Diff.
+func (c *Client) Diff(ctx context.Context, obj *unstructured.Unstructured) (*Result, error) {
+	r, live, merged, err := c.apply(ctx, obj, true)
+	if err != nil {
+		return nil, err
+	}
+	a, err := diffable(live)
+	if err != nil {
+		return nil, err
+	}
+	b, err := diffable(merged)
+	if err != nil {
+		return nil, err
+	}
+	name := Describe(obj)
+	r.Diff, err = difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(a),
+		B:        difflib.SplitLines(b),
+		FromFile: "live/" + name,
+		ToFile:   "merged/" + name,
+		Context:  3,
+	})
+	return r, err
+}
+
+// apply applies obj, returning the live object it replaced, if any, and
+// the object left.
+func (c *Client) apply(ctx context.Context, obj *unstructured.Unstructured, dryRun bool) (r *Result, live, applied *unstructured.Unstructured, err error) {
+	res, err := c.resource(obj)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	live, err = res.Get(ctx, obj.GetName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		live = nil
+	} else if err != nil {
+		return nil, nil, nil, err
+	}
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	force := true
+	opts := metav1.PatchOptions{FieldManager: FieldManager, Force: &force}
+	if dryRun {
+		opts.DryRun = []string{metav1.DryRunAll}
+	}
+	applied, err = res.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	action := Configured
+	switch {
+	case live == nil:
+		action = Created
+	case !dryRun && applied.GetResourceVersion() == live.GetResourceVersion():
+		action = Unchanged
+	case dryRun:
+		// Nothing is written, so the resourceVersion stays the same.
+		a, err := diffable(live)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		b, err := diffable(applied)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if a == b {
+			action = Unchanged
+		}
+	}
+	r = c.result(obj, action)
+	r.DryRun = dryRun
+	return r, live, applied, nil
+}
+
+// diffable returns obj as YAML, without the fields recording who manages
+// which fields, which change on every apply, or "" if obj is nil.
+func diffable(obj *unstructured.Unstructured) (string, error) {
+	if obj == nil {
+		return "", nil
+	}
+	obj = obj.DeepCopy()
+	obj.SetManagedFields(nil)
+	b, err := sigsyaml.Marshal(obj.Object)
+	return string(b), err
+}
+
+// Create creates obj, failing if it already exists.
+func (c *Client) Create(ctx context.Context, obj *unstructured.Unstructured) (*Result, error) {
+	res, err := c.resource(obj)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := res.Create(ctx, obj, metav1.CreateOptions{FieldManager: FieldManager}); err != nil {
+		return nil, err
+	}
+	return c.result(obj, Created), nil
+}
+
+// Delete deletes obj, leaving the objects it owns to be garbage collected
+// in the background.
+func (c *Client) Delete(ctx context.Context, obj *unstructured.Unstructured) (*Result, error) {
+	res, err := c.resource(obj)
+	if err != nil {
+		return nil, err
+	}
+	policy := metav1.DeletePropagationBackground
+	if err := res.Delete(ctx, obj.GetName(), metav1.DeleteOptions{PropagationPolicy: &policy}); err != nil {
+		return nil, err
+	}
+	return c.result(obj, Deleted), nil
+}
+
+func (c *Client) result(obj *unstructured.Unstructured, action string) *Result {
+	return &Result{
+		APIVersion: obj.GetAPIVersion(),
+		Kind:       obj.GetKind(),
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+		Action:     action,
+	}
+}
+
+// resource returns the client for the resource of obj, setting the
+// namespace of namespaced objects which don't have one.
+func (c *Client) resource(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+	mapping, err := c.mapping(obj.GroupVersionKind())
+	if err != nil {
+		return nil, err
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return c.dyn.Resource(mapping.Resource), nil
+	}
+	if obj.GetNamespace() == "" {
+		obj.SetNamespace(c.namespace)
+	}
+	return c.dyn.Resource(mapping.Resource).Namespace(obj.GetNamespace()), nil
+}
+
+// resourceFor returns the client for the resource of a kind, in namespace,
+// or the client's namespace if empty, if it is namespaced.
+func (c *Client) resourceFor(gvk schema.GroupVersionKind, namespace string) (dynamic.ResourceInterface, error) {
+	mapping, err := c.mapping(gvk)
+	if err != nil {
+		return nil, err
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return c.dyn.Resource(mapping.Resource), nil
+	}
+	if namespace == "" {
+		namespace = c.namespace
+	}
+	return c.dyn.Resource(mapping.Resource).Namespace(namespace), nil
+}
+
+// mapping returns the resource of a kind.
+func (c *Client) mapping(gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if r, ok := c.mapper.(meta.ResettableRESTMapper); ok && meta.IsNoMatchError(err) {
+		// The kind may have been defined since the mapper discovered the
+		// cluster's resources, eg: by a CRD earlier in the manifest.
+		r.Reset()
+		mapping, err = c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	return mapping, err
+}
@@ -0,0 +1,298 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// newFakeClient returns a client of a fake cluster holding objs, knowing
+// of config maps, namespaces, pods and deployments.
+func newFakeClient(objs ...runtime.Object) *Client {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+	dyn := fake.NewSimpleDynamicClient(runtime.NewScheme(), objs...)
+	dyn.PrependReactor("patch", "*", applyReactor(dyn.Tracker()))
+	return NewClient(dyn, kubefake.NewSimpleClientset(), mapper, "default")
+}
+
+// applyReactor emulates server-side apply, which the fake client doesn't
+// support: objects are created or replaced, and their resourceVersion
+// bumped if they changed.
+func applyReactor(tracker clienttesting.ObjectTracker) clienttesting.ReactionFunc {
+	return func(action clienttesting.Action) (bool, runtime.Object, error) {
+		pa := action.(clienttesting.PatchAction)
+		if pa.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(pa.GetPatch()); err != nil {
+			return true, nil, err
+		}
+		gvr, ns := pa.GetResource(), pa.GetNamespace()
+		live, err := tracker.Get(gvr, ns, pa.GetName())
+		if apierrors.IsNotFound(err) {
+			obj.SetResourceVersion("1")
+			return true, obj, tracker.Create(gvr, obj, ns)
+		} else if err != nil {
+			return true, nil, err
+		}
+		rv := live.(*unstructured.Unstructured).GetResourceVersion()
+		obj.SetResourceVersion(rv)
+		if equality.Semantic.DeepEqual(obj, live) {
+			return true, live, nil
+		}
+		n, _ := strconv.Atoi(rv)
+		obj.SetResourceVersion(strconv.Itoa(n + 1))
+		return true, obj, tracker.Update(gvr, obj, ns)
+	}
+}
+
+func configMap(name, value string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default", "resourceVersion": "1"},
+		"data":       map[string]interface{}{"a": value},
+	}}
+}
+
+func TestClient(t *testing.T) {
+	tests := []struct {
+		name     string
+		action   string
+		manifest string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			"Apply new",
+			"apply",
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: new\ndata:\n  a: \"1\"\n",
+			[]string{"configmap/new created"},
+			false,
+		},
+		{
+			"Apply unchanged",
+			"apply",
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: existing\ndata:\n  a: \"1\"\n",
+			[]string{"configmap/existing unchanged"},
+			false,
+		},
+		{
+			"Apply changed",
+			"apply",
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: existing\ndata:\n  a: \"2\"\n",
+			[]string{"configmap/existing configured"},
+			false,
+		},
+		{
+			"Apply several",
+			"apply",
+			"apiVersion: v1\nkind: Namespace\nmetadata:\n  name: demo\n---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  namespace: demo\n",
+			[]string{"namespace/demo created", "deployment.apps/web created"},
+			false,
+		},
+		{
+			"Dry run new",
+			"dryRun",
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: new\n",
+			[]string{"configmap/new created (server dry run)"},
+			false,
+		},
+		{
+			"Dry run unchanged",
+			"dryRun",
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: existing\ndata:\n  a: \"1\"\n",
+			[]string{"configmap/existing unchanged (server dry run)"},
+			false,
+		},
+		{
+			"Create",
+			"create",
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: new\n",
+			[]string{"configmap/new created"},
+			false,
+		},
+		{
+			"Create existing",
+			"create",
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: existing\n",
+			nil,
+			true,
+		},
+		{
+			"Delete",
+			"delete",
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: existing\n",
+			[]string{"configmap/existing deleted"},
+			false,
+		},
+		{
+			"Delete missing",
+			"delete",
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: new\n",
+			nil,
+			true,
+		},
+		{
+			"Unknown kind",
+			"apply",
+			"apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: w\n",
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeClient(configMap("existing", "1"))
+			objs, err := Decode(tt.manifest)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			var got []string
+			for _, obj := range objs {
+				r, err := c.Do(context.Background(), tt.action, obj)
+				if err != nil {
+					if !tt.wantErr {
+						t.Fatalf("Do() error = %v", err)
+					}
+					return
+				}
+				got = append(got, r.String())
+			}
+			if tt.wantErr {
+				t.Fatalf("Do() succeeded with %q, want an error", got)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got results %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got result %q, want %q", got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     string   // action
+		wantDiff []string // lines of the diff
+	}{
+		{
+			"Changed",
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: existing\ndata:\n  a: \"2\"\n",
+			Configured,
+			[]string{"--- live/configmap/existing", "+++ merged/configmap/existing", `-  a: "1"`, `+  a: "2"`},
+		},
+		{
+			"Unchanged",
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: existing\ndata:\n  a: \"1\"\n",
+			Unchanged,
+			nil,
+		},
+		{
+			"New",
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: new\ndata:\n  a: \"1\"\n",
+			Created,
+			[]string{"+++ merged/configmap/new", "+kind: ConfigMap", `+  a: "1"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The fake client can't tell dry runs apart, so a fresh one is
+			// needed for each case.
+			c := newFakeClient(configMap("existing", "1"))
+			objs, err := Decode(tt.manifest)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			r, err := c.Diff(context.Background(), objs[0])
+			if err != nil {
+				t.Fatalf("Diff() error = %v", err)
+			}
+			if r.Action != tt.want || !r.DryRun {
+				t.Errorf("got %q, want action %q in a dry run", r, tt.want)
+			}
+			if tt.wantDiff == nil && r.Diff != "" {
+				t.Errorf("got diff %q, want none", r.Diff)
+			}
+			lines := strings.Split(r.Diff, "\n")
+			for _, want := range tt.wantDiff {
+				found := false
+				for _, l := range lines {
+					found = found || strings.HasPrefix(l, want)
+				}
+				if !found {
+					t.Errorf("diff %q has no line %q", r.Diff, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     []string // names of the objects
+		wantErr  bool
+	}{
+		{"Single", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n", []string{"configmap/a"}, false},
+		{"Empty documents", "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n---\n---\napiVersion: v1\nkind: Service\nmetadata:\n  name: b\n", []string{"configmap/a", "service/b"}, false},
+		{"JSON", `{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "web"}}`, []string{"deployment.apps/web"}, false},
+		{"List", "apiVersion: v1\nkind: List\nitems:\n- apiVersion: v1\n  kind: ConfigMap\n  metadata:\n    name: a\n- apiVersion: v1\n  kind: ConfigMap\n  metadata:\n    name: b\n", []string{"configmap/a", "configmap/b"}, false},
+		{"Missing kind", "apiVersion: v1\nmetadata:\n  name: a\n", nil, true},
+		{"No objects", "---\n", nil, true},
+		{"Bad YAML", "kind: [\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs, err := Decode(tt.manifest)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(objs) != len(tt.want) {
+				t.Fatalf("got %d objects, want %d", len(objs), len(tt.want))
+			}
+			for i, obj := range objs {
+				if got := Describe(obj); got != tt.want[i] {
+					t.Errorf("got object %q, want %q", got, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// tailLines is how many of the lines containers logged before their logs
+// were followed are sent, like kubectl logs with a selector.
+const tailLines = 10
+
+// LogLine is a line logged by a container.
+type LogLine struct {
+	Pod       string
+	Container string
+	Text      string `json:",omitempty"` // without the newline
+	Err       string `json:",omitempty"` // why the logs can't be followed, instead of Text
+}
+
+// String returns the line prefixed with its pod and container like
+// kubectl logs --prefix, eg: "[pod/nginx-5d8f/nginx] listening".
+func (l *LogLine) String() string {
+	s := "[pod/" + l.Pod + "/" + l.Container + "] "
+	if l.Err != "" {
+		return s + l.Err
+	}
+	return s + l.Text
+}
+
+// Logs follows the logs of every container of the pods matching selector
+// in namespace, or the client's namespace if empty, until ctx is done.
+// Containers are followed again when they restart, and pods as they are
+// added. line is called with each line, from several goroutines.
+func (c *Client) Logs(ctx context.Context, namespace, selector string, line func(*LogLine)) error {
+	if c.cs == nil {
+		return errors.New("reading logs is not supported by this client")
+	}
+	if namespace == "" {
+		namespace = c.namespace
+	}
+	f := &follower{
+		c:         c,
+		ctx:       ctx,
+		namespace: namespace,
+		line:      line,
+		started:   time.Now(),
+		restarts:  make(map[string]int32),
+		cancel:    make(map[string]func()),
+	}
+	err := c.Watch(ctx, Query{APIVersion: "v1", Kind: "Pod", Namespace: namespace, Selector: selector}, f.event)
+	f.wg.Wait()
+	return err
+}
+
+// follower follows the logs of the containers of the pods it is told of.
+type follower struct {
+	c         *Client
+	ctx       context.Context
+	namespace string
+	line      func(*LogLine)
+	started   time.Time
+
+	// By pod/container: the restart count of the containers followed, and
+	// the functions stopping their latest logs.
+	restarts map[string]int32
+	cancel   map[string]func()
+	wg       sync.WaitGroup
+}
+
+// event follows the containers of a pod which started since it was last
+// seen, and stops following the containers of deleted pods.
+func (f *follower) event(e *Event) {
+	var pod corev1.Pod
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(e.Object, &pod); err != nil {
+		return
+	}
+	prefix := pod.Name + "/"
+	if e.Type == string(watch.Deleted) {
+		for key, cancel := range f.cancel {
+			if strings.HasPrefix(key, prefix) {
+				cancel()
+				delete(f.cancel, key)
+				delete(f.restarts, key)
+			}
+		}
+		return
+	}
+	statuses := append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...)
+	for _, st := range statuses {
+		var started time.Time
+		switch {
+		case st.State.Running != nil:
+			started = st.State.Running.StartedAt.Time
+		case st.State.Terminated != nil:
+			started = st.State.Terminated.StartedAt.Time
+		default:
+			continue // no logs yet
+		}
+		key := prefix + st.Name
+		if n, ok := f.restarts[key]; ok && n == st.RestartCount {
+			continue // already followed
+		}
+		// A new container, or one which restarted. The logs of the one it
+		// replaced end by themselves.
+		ctx, cancel := context.WithCancel(f.ctx)
+		f.restarts[key], f.cancel[key] = st.RestartCount, cancel
+		opts := &corev1.PodLogOptions{Container: st.Name, Follow: true}
+		if started.Before(f.started) {
+			n := int64(tailLines)
+			opts.TailLines = &n
+		}
+		f.wg.Add(1)
+		go f.follow(ctx, pod.Name, opts)
+	}
+}
+
+// follow sends the lines logged by a container until its logs end or ctx
+// is done.
+func (f *follower) follow(ctx context.Context, pod string, opts *corev1.PodLogOptions) {
+	defer f.wg.Done()
+	fail := func(err error) {
+		if ctx.Err() == nil {
+			f.line(&LogLine{Pod: pod, Container: opts.Container, Err: err.Error()})
+		}
+	}
+	stream, err := f.c.cs.CoreV1().Pods(f.namespace).GetLogs(pod, opts).Stream(ctx)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer stream.Close()
+	r := bufio.NewReader(stream)
+	for {
+		s, err := r.ReadString('\n')
+		if s != "" {
+			f.line(&LogLine{Pod: pod, Container: opts.Container, Text: strings.TrimSuffix(s, "\n")})
+		}
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fail(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// pod returns a pod labelled app, whose containers have been running since
+// started and restarted as many times as given.
+func pod(name, app string, started time.Time, restarts map[string]int32) *unstructured.Unstructured {
+	p := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": app}},
+	}
+	for container, n := range restarts {
+		p.Status.ContainerStatuses = append(p.Status.ContainerStatuses, corev1.ContainerStatus{
+			Name:         container,
+			RestartCount: n,
+			State:        corev1.ContainerState{Running: &corev1.ContainerStateRunning{StartedAt: metav1.NewTime(started)}},
+		})
+	}
+	obj, _ := runtime.DefaultUnstructuredConverter.ToUnstructured(p)
+	return &unstructured.Unstructured{Object: obj}
+}
+
+func TestLogs(t *testing.T) {
+	before := time.Now().Add(-time.Hour)
+	c := newFakeClient(
+		pod("web-1", "web", before, map[string]int32{"nginx": 0, "sidecar": 0}),
+		pod("db-1", "db", before, map[string]int32{"postgres": 0}),
+	)
+
+	dyn := c.dyn.(*fake.FakeDynamicClient)
+	watching := make(chan struct{})
+	var once sync.Once
+	dyn.PrependWatchReactor("*", func(action clienttesting.Action) (bool, watch.Interface, error) {
+		w, err := dyn.Tracker().Watch(action.GetResource(), action.GetNamespace())
+		once.Do(func() { close(watching) })
+		return true, w, err
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	lines := make(chan *LogLine)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Logs(ctx, "", "app=web", func(l *LogLine) {
+			lines <- l
+		})
+	}()
+	receive := func(n int) []string {
+		var got []string
+		for i := 0; i < n; i++ {
+			select {
+			case l := <-lines:
+				got = append(got, l.String())
+			case err := <-errc:
+				t.Fatalf("Logs() returned early: %v", err)
+			}
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	// The fake clientset logs "fake logs" without a newline.
+	want := []string{"[pod/web-1/nginx] fake logs", "[pod/web-1/sidecar] fake logs"}
+	if got := receive(2); !reflect.DeepEqual(got, want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+
+	// A restarted container is followed again, from its start.
+	<-watching
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	restarted := pod("web-1", "web", time.Now().Add(time.Hour), map[string]int32{"nginx": 1, "sidecar": 0})
+	if err := dyn.Tracker().Update(gvr, restarted, "default"); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"[pod/web-1/nginx] fake logs"}
+	if got := receive(1); !reflect.DeepEqual(got, want) {
+		t.Errorf("after restart got lines %q, want %q", got, want)
+	}
+
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("Logs() error = %v, want %v", err, context.Canceled)
+	}
+
+	var tails []string
+	for _, a := range c.cs.(*kubefake.Clientset).Actions() {
+		if a.GetSubresource() != "log" {
+			continue
+		}
+		opts := a.(clienttesting.GenericAction).GetValue().(*corev1.PodLogOptions)
+		tail := "all"
+		if opts.TailLines != nil {
+			tail = "tail"
+		}
+		tails = append(tails, opts.Container+" "+tail)
+	}
+	sort.Strings(tails)
+	want = []string{"nginx all", "nginx tail", "sidecar tail"}
+	if !reflect.DeepEqual(tails, want) {
+		t.Errorf("followed logs %q, want %q", tails, want)
+	}
+}
+
+func TestLogLine(t *testing.T) {
+	tests := []struct {
+		name string
+		l    LogLine
+		want string
+	}{
+		{"Line", LogLine{Pod: "web-1", Container: "nginx", Text: "listening"}, "[pod/web-1/nginx] listening"},
+		{"Error", LogLine{Pod: "web-1", Container: "nginx", Err: "pods \"web-1\" not found"}, "[pod/web-1/nginx] pods \"web-1\" not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.l.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
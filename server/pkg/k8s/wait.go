@@ -0,0 +1,237 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// Status is how far an object is from being ready.
+type Status struct {
+	APIVersion string
+	Kind       string
+	Namespace  string `json:",omitempty"`
+	Name       string
+	Ready      bool
+	Message    string // eg: "2 of 3 updated replicas are available"
+}
+
+// String describes the status, eg:
+// "deployment.apps/nginx: 2 of 3 updated replicas are available".
+func (s *Status) String() string {
+	return resourceName(s.APIVersion, s.Kind, s.Name) + ": " + s.Message
+}
+
+// Wait waits for obj to become ready, calling status with its status
+// whenever it changes, until it is ready or ctx is done.
+func (c *Client) Wait(ctx context.Context, obj *unstructured.Unstructured, status func(*Status)) error {
+	res, err := c.resource(obj)
+	if err != nil {
+		return err
+	}
+	var last string
+	check := func(live *unstructured.Unstructured) bool {
+		s := ready(live)
+		if s.Message != last {
+			last = s.Message
+			status(s)
+		}
+		return s.Ready
+	}
+	for {
+		live, err := res.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if check(live) {
+			return nil
+		}
+		w, err := res.Watch(ctx, metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", obj.GetName()).String(),
+			ResourceVersion: live.GetResourceVersion(),
+		})
+		if expired(err) {
+			continue // compacted away since the get; get it again
+		} else if err != nil {
+			return err
+		}
+		ok, err := watchUntil(ctx, w, obj.GetName(), check)
+		w.Stop()
+		if ok || (err != nil && !expired(err)) {
+			return err
+		}
+		// The server closed the watch, or fell behind; get the object
+		// again and start another.
+	}
+}
+
+// watchUntil watches the object with the given name until check reports
+// it ready, returning false if the watch closes first.
+func watchUntil(ctx context.Context, w watch.Interface, name string, check func(*unstructured.Unstructured) bool) (bool, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case e, ok := <-w.ResultChan():
+			if !ok {
+				return false, nil
+			}
+			if e.Type == watch.Error {
+				return false, apierrors.FromObject(e.Object)
+			}
+			obj, ok := e.Object.(*unstructured.Unstructured)
+			if !ok || obj.GetName() != name {
+				continue
+			}
+			switch e.Type {
+			case watch.Deleted:
+				return false, fmt.Errorf("%s was deleted", Describe(obj))
+			case watch.Added, watch.Modified:
+				if check(obj) {
+					return true, nil
+				}
+			}
+		}
+	}
+}
+
+// ready returns the status of obj: Deployments are ready once rolled out,
+// Pods once running and ready or succeeded, and other objects once their
+// controller has observed their latest generation, and their Ready, or
+// failing that Available, condition is true. Objects with neither, eg:
+// ConfigMaps, are ready straight away.
+func ready(obj *unstructured.Unstructured) *Status {
+	s := &Status{
+		APIVersion: obj.GetAPIVersion(),
+		Kind:       obj.GetKind(),
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+	}
+	s.Ready, s.Message = true, "ready"
+	gk := obj.GroupVersionKind().GroupKind()
+	switch {
+	case gk.Group == "apps" && gk.Kind == "Deployment":
+		s.Ready, s.Message = deploymentReady(obj)
+	case gk.Group == "" && gk.Kind == "Pod":
+		s.Ready, s.Message = podReady(obj)
+	default:
+		if !observed(obj) {
+			s.Ready, s.Message = false, "waiting for the latest generation to be observed"
+			break
+		}
+		for _, t := range []string{"Ready", "Available"} {
+			if c := condition(obj, t); c != nil {
+				s.Ready, s.Message = c.status == "True", c.String()
+				break
+			}
+		}
+	}
+	return s
+}
+
+// deploymentReady reports whether a Deployment has rolled out, like
+// kubectl rollout status.
+func deploymentReady(obj *unstructured.Unstructured) (bool, string) {
+	if !observed(obj) {
+		return false, "waiting for the rollout to be observed"
+	}
+	if c := condition(obj, "Progressing"); c != nil && c.reason == "ProgressDeadlineExceeded" {
+		return false, "rollout exceeded its progress deadline"
+	}
+	replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if !found {
+		replicas = 1
+	}
+	updated, _, _ := unstructured.NestedInt64(obj.Object, "status", "updatedReplicas")
+	total, _, _ := unstructured.NestedInt64(obj.Object, "status", "replicas")
+	available, _, _ := unstructured.NestedInt64(obj.Object, "status", "availableReplicas")
+	switch {
+	case updated < replicas:
+		return false, fmt.Sprintf("%d of %d new replicas have been updated", updated, replicas)
+	case total > updated:
+		return false, fmt.Sprintf("%d old replicas are pending termination", total-updated)
+	case available < updated:
+		return false, fmt.Sprintf("%d of %d updated replicas are available", available, updated)
+	}
+	return true, "successfully rolled out"
+}
+
+// podReady reports whether a Pod is running and ready, or has succeeded.
+func podReady(obj *unstructured.Unstructured) (bool, string) {
+	phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+	switch phase {
+	case "Succeeded":
+		return true, "succeeded"
+	case "Failed":
+		return false, "failed"
+	case "Running":
+		if c := condition(obj, "Ready"); c != nil && c.status == "True" {
+			return true, "running and ready"
+		} else if c != nil {
+			return false, "running, " + c.String()
+		}
+		return false, "running"
+	case "":
+		return false, "pending"
+	}
+	return false, "phase " + phase
+}
+
+// observed reports whether the controller of obj has observed its latest
+// generation, assuming it has if obj doesn't report which it observed.
+func observed(obj *unstructured.Unstructured) bool {
+	g, found, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+	return !found || g >= obj.GetGeneration()
+}
+
+// statusCondition is one of the conditions in the status of an object.
+type statusCondition struct {
+	typ, status, reason, message string
+}
+
+func (c *statusCondition) String() string {
+	s := c.typ + "=" + c.status
+	if c.reason != "" {
+		s += " (" + c.reason + ")"
+	}
+	if c.message != "" {
+		s += ": " + c.message
+	}
+	return s
+}
+
+// condition returns the condition of obj with the given type, or nil.
+func condition(obj *unstructured.Unstructured, typ string) *statusCondition {
+	conds, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conds {
+		m, ok := c.(map[string]interface{})
+		if !ok || m["type"] != typ {
+			continue
+		}
+		str := func(k string) string {
+			s, _ := m[k].(string)
+			return s
+		}
+		return &statusCondition{typ: typ, status: str("status"), reason: str("reason"), message: str("message")}
+	}
+	return nil
+}
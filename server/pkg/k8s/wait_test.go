@@ -0,0 +1,190 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+// object returns an object in the default namespace with the given status.
+func object(apiVersion, kind string, spec, status map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": "x", "namespace": "default", "generation": int64(2)},
+	}}
+	if spec != nil {
+		obj.Object["spec"] = spec
+	}
+	if status != nil {
+		obj.Object["status"] = status
+	}
+	return obj
+}
+
+func conditions(typ, status, reason string) map[string]interface{} {
+	return map[string]interface{}{"conditions": []interface{}{
+		map[string]interface{}{"type": typ, "status": status, "reason": reason},
+	}}
+}
+
+func TestReady(t *testing.T) {
+	replicas := map[string]interface{}{"replicas": int64(3)}
+	tests := []struct {
+		name    string
+		obj     *unstructured.Unstructured
+		want    bool
+		wantMsg string
+	}{
+		{"Config map", object("v1", "ConfigMap", nil, nil), true, "ready"},
+		{
+			"Deployment not observed",
+			object("apps/v1", "Deployment", replicas, map[string]interface{}{"observedGeneration": int64(1)}),
+			false,
+			"waiting for the rollout to be observed",
+		},
+		{
+			"Deployment updating",
+			object("apps/v1", "Deployment", replicas, map[string]interface{}{"observedGeneration": int64(2), "replicas": int64(3), "updatedReplicas": int64(1)}),
+			false,
+			"1 of 3 new replicas have been updated",
+		},
+		{
+			"Deployment terminating",
+			object("apps/v1", "Deployment", replicas, map[string]interface{}{"observedGeneration": int64(2), "replicas": int64(4), "updatedReplicas": int64(3)}),
+			false,
+			"1 old replicas are pending termination",
+		},
+		{
+			"Deployment unavailable",
+			object("apps/v1", "Deployment", replicas, map[string]interface{}{"observedGeneration": int64(2), "replicas": int64(3), "updatedReplicas": int64(3), "availableReplicas": int64(2)}),
+			false,
+			"2 of 3 updated replicas are available",
+		},
+		{
+			"Deployment rolled out",
+			object("apps/v1", "Deployment", replicas, map[string]interface{}{"observedGeneration": int64(2), "replicas": int64(3), "updatedReplicas": int64(3), "availableReplicas": int64(3)}),
+			true,
+			"successfully rolled out",
+		},
+		{"Pod pending", object("v1", "Pod", nil, nil), false, "pending"},
+		{"Pod running", object("v1", "Pod", nil, map[string]interface{}{"phase": "Running"}), false, "running"},
+		{
+			"Pod ready",
+			object("v1", "Pod", nil, map[string]interface{}{"phase": "Running", "conditions": []interface{}{map[string]interface{}{"type": "Ready", "status": "True"}}}),
+			true,
+			"running and ready",
+		},
+		{"Pod succeeded", object("v1", "Pod", nil, map[string]interface{}{"phase": "Succeeded"}), true, "succeeded"},
+		{"Custom resource not ready", object("example.com/v1", "Widget", nil, conditions("Ready", "False", "Reconciling")), false, "Ready=False (Reconciling)"},
+		{"Custom resource ready", object("example.com/v1", "Widget", nil, conditions("Ready", "True", "")), true, "Ready=True"},
+		{"Custom resource available", object("example.com/v1", "Widget", nil, conditions("Available", "True", "")), true, "Available=True"},
+		{
+			"Custom resource not observed",
+			object("example.com/v1", "Widget", nil, map[string]interface{}{"observedGeneration": int64(1)}),
+			false,
+			"waiting for the latest generation to be observed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := ready(tt.obj)
+			if s.Ready != tt.want || s.Message != tt.wantMsg {
+				t.Errorf("ready() = %v %q, want %v %q", s.Ready, s.Message, tt.want, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	replicas := map[string]interface{}{"replicas": int64(1)}
+	unavailable := map[string]interface{}{"replicas": int64(1), "updatedReplicas": int64(1)}
+	available := map[string]interface{}{"replicas": int64(1), "updatedReplicas": int64(1), "availableReplicas": int64(1)}
+	tests := []struct {
+		name    string
+		obj     *unstructured.Unstructured
+		update  *unstructured.Unstructured // made while waiting, if any
+		expire  bool                       // the first watch expires
+		want    []string                   // status messages
+		wantErr bool
+	}{
+		{"Ready", object("v1", "ConfigMap", nil, nil), nil, false, []string{"ready"}, false},
+		{
+			"Becomes ready",
+			object("apps/v1", "Deployment", replicas, unavailable),
+			object("apps/v1", "Deployment", replicas, available),
+			false,
+			[]string{"0 of 1 updated replicas are available", "successfully rolled out"},
+			false,
+		},
+		{
+			"Becomes ready after watch expired",
+			object("apps/v1", "Deployment", replicas, unavailable),
+			object("apps/v1", "Deployment", replicas, available),
+			true,
+			[]string{"0 of 1 updated replicas are available", "successfully rolled out"},
+			false,
+		},
+		{"Timed out", object("v1", "Pod", nil, nil), nil, false, []string{"pending"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeClient(tt.obj)
+			if tt.expire {
+				expireFirstWatch(c.dyn.(*fake.FakeDynamicClient), nil)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			done := make(chan struct{})
+			defer close(done)
+			if tt.update != nil {
+				// Keep updating, as the watch may not have started yet.
+				gvr := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+				tracker := c.dyn.(*fake.FakeDynamicClient).Tracker()
+				go func() {
+					for {
+						select {
+						case <-done:
+							return
+						case <-time.After(10 * time.Millisecond):
+							tracker.Update(gvr, tt.update.DeepCopy(), "default")
+						}
+					}
+				}()
+			}
+			var got []string
+			err := c.Wait(ctx, tt.obj, func(s *Status) {
+				got = append(got, s.Message)
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Wait() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got statuses %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got status %q, want %q", got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"errors"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+)
+
+// lastApplied is the annotation kubectl apply keeps the applied object in.
+const lastApplied = "kubectl.kubernetes.io/last-applied-configuration"
+
+// Event is a change to a watched object.
+type Event struct {
+	Type      string // "ADDED", "MODIFIED" or "DELETED"
+	Kind      string
+	Namespace string `json:",omitempty"`
+	Name      string
+	Object    map[string]interface{} // trimmed of bookkeeping, eg: managed fields
+}
+
+// String describes the event, eg: "ADDED deployment.apps/nginx".
+func (e *Event) String() string {
+	u := unstructured.Unstructured{Object: e.Object}
+	return e.Type + " " + Describe(&u)
+}
+
+// Query selects the objects to watch.
+type Query struct {
+	APIVersion string // eg: "apps/v1"
+	Kind       string // eg: "Deployment"
+	Namespace  string // the client's namespace if empty
+	Selector   string // label selector, eg: "app=nginx"; all objects if empty
+}
+
+// Watch calls event with each object matching q, as added, then with every
+// change to them until ctx is done.
+func (c *Client) Watch(ctx context.Context, q Query, event func(*Event)) error {
+	if q.APIVersion == "" || q.Kind == "" {
+		return errors.New("an apiVersion and kind to watch are needed")
+	}
+	if _, err := labels.Parse(q.Selector); err != nil {
+		return err
+	}
+	gv, err := schema.ParseGroupVersion(q.APIVersion)
+	if err != nil {
+		return err
+	}
+	res, err := c.resourceFor(gv.WithKind(q.Kind), q.Namespace)
+	if err != nil {
+		return err
+	}
+	w := &watcher{res: res, selector: q.Selector, event: event, known: make(map[string]*unstructured.Unstructured)}
+	for {
+		rv, err := w.list(ctx)
+		if err != nil {
+			return err
+		}
+		if err := w.watch(ctx, rv); !expired(err) {
+			return err
+		}
+		// The changes since rv were compacted away; list the objects
+		// again, and report how they changed in the meantime.
+	}
+}
+
+// expired reports whether err is the server refusing to watch from a
+// resourceVersion it no longer has, routine once etcd compacts its history.
+func expired(err error) bool {
+	return apierrors.IsResourceExpired(err) || apierrors.IsGone(err)
+}
+
+// watcher follows the changes to a set of objects, keeping the objects
+// seen so that it can list them again after falling behind.
+type watcher struct {
+	res      dynamic.ResourceInterface
+	selector string
+	event    func(*Event)
+	known    map[string]*unstructured.Unstructured // by namespace/name
+}
+
+// list lists the objects, calling event with those added, changed or
+// deleted since they were last seen, and returns the resourceVersion to
+// watch from.
+func (w *watcher) list(ctx context.Context) (string, error) {
+	list, err := w.res.List(ctx, metav1.ListOptions{LabelSelector: w.selector})
+	if err != nil {
+		return "", err
+	}
+	listed := make(map[string]bool, len(list.Items))
+	for i := range list.Items {
+		obj := &list.Items[i]
+		key := objectKey(obj)
+		listed[key] = true
+		switch old := w.known[key]; {
+		case old == nil:
+			w.seen(watch.Added, obj)
+		case old.GetResourceVersion() != obj.GetResourceVersion():
+			w.seen(watch.Modified, obj)
+		}
+	}
+	for key, obj := range w.known {
+		if !listed[key] {
+			w.seen(watch.Deleted, obj)
+		}
+	}
+	return list.GetResourceVersion(), nil
+}
+
+// watch calls event with the changes from rv on until ctx is done, or the
+// watch fails.
+func (w *watcher) watch(ctx context.Context, rv string) error {
+	opts := metav1.ListOptions{LabelSelector: w.selector, ResourceVersion: rv}
+	for {
+		wi, err := w.res.Watch(ctx, opts)
+		if err != nil {
+			return err
+		}
+		opts.ResourceVersion, err = w.forward(ctx, wi, opts.ResourceVersion)
+		wi.Stop()
+		if err != nil {
+			return err
+		}
+		// The server closed the watch; carry on from the last change seen.
+	}
+}
+
+// forward calls event with the changes seen by wi until it closes,
+// returning the resourceVersion of the last one.
+func (w *watcher) forward(ctx context.Context, wi watch.Interface, rv string) (string, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return rv, ctx.Err()
+		case e, ok := <-wi.ResultChan():
+			if !ok {
+				return rv, nil
+			}
+			if e.Type == watch.Error {
+				return rv, apierrors.FromObject(e.Object)
+			}
+			obj, ok := e.Object.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			rv = obj.GetResourceVersion()
+			if e.Type != watch.Bookmark {
+				w.seen(e.Type, obj)
+			}
+		}
+	}
+}
+
+// seen records the change of type t to obj, and calls event with it.
+func (w *watcher) seen(t watch.EventType, obj *unstructured.Unstructured) {
+	if t == watch.Deleted {
+		delete(w.known, objectKey(obj))
+	} else {
+		w.known[objectKey(obj)] = obj
+	}
+	w.event(newEvent(t, obj))
+}
+
+func objectKey(obj *unstructured.Unstructured) string {
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// newEvent returns the event of type t for obj, trimming the fields
+// recording who manages which fields and the object last applied by
+// kubectl, which are long and of little interest on a slide.
+func newEvent(t watch.EventType, obj *unstructured.Unstructured) *Event {
+	obj = obj.DeepCopy()
+	obj.SetManagedFields(nil)
+	if a := obj.GetAnnotations(); a[lastApplied] != "" {
+		delete(a, lastApplied)
+		obj.SetAnnotations(a)
+	}
+	return &Event{
+		Type:      string(t),
+		Kind:      obj.GetKind(),
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+		Object:    obj.Object,
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestWatch(t *testing.T) {
+	web := configMap("web", "1")
+	web.SetLabels(map[string]string{"app": "web"})
+	web.SetAnnotations(map[string]string{lastApplied: "{}", "note": "kept"})
+	db := configMap("db", "1")
+	db.SetLabels(map[string]string{"app": "db"})
+	c := newFakeClient(web, db)
+
+	// Watch the tracker directly, to know when changes will be seen.
+	dyn := c.dyn.(*fake.FakeDynamicClient)
+	watching := make(chan struct{})
+	var once sync.Once
+	dyn.PrependWatchReactor("*", func(action clienttesting.Action) (bool, watch.Interface, error) {
+		w, err := dyn.Tracker().Watch(action.GetResource(), action.GetNamespace())
+		once.Do(func() { close(watching) })
+		return true, w, err
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	events := make(chan *Event)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Watch(ctx, Query{APIVersion: "v1", Kind: "ConfigMap", Selector: "app=web"}, func(e *Event) {
+			events <- e
+		})
+	}()
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	tracker := dyn.Tracker()
+	api := configMap("api", "1")
+	api.SetLabels(map[string]string{"app": "web"})
+	go func() {
+		<-watching
+		tracker.Create(gvr, api, "default")
+		api2 := api.DeepCopy()
+		unstructured.SetNestedField(api2.Object, "2", "data", "a")
+		tracker.Update(gvr, api2, "default")
+		tracker.Delete(gvr, "default", "api")
+	}()
+
+	tests := []struct {
+		typ  string
+		name string
+	}{
+		{"ADDED", "web"},
+		{"ADDED", "api"},
+		{"MODIFIED", "api"},
+		{"DELETED", "api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ+" "+tt.name, func(t *testing.T) {
+			var e *Event
+			select {
+			case e = <-events:
+			case err := <-errc:
+				t.Fatalf("Watch() returned early: %v", err)
+			}
+			if e.Type != tt.typ || e.Name != tt.name || e.Namespace != "default" || e.Kind != "ConfigMap" {
+				t.Fatalf("got event %s %s/%s %s, want %s default/%s ConfigMap", e.Type, e.Namespace, e.Name, e.Kind, tt.typ, tt.name)
+			}
+			u := unstructured.Unstructured{Object: e.Object}
+			if a := u.GetAnnotations(); a[lastApplied] != "" {
+				t.Errorf("got last applied annotation in %v", e.Object)
+			}
+		})
+	}
+	if a := (&unstructured.Unstructured{Object: web.Object}).GetAnnotations(); a[lastApplied] == "" || a["note"] != "kept" {
+		t.Errorf("watched object was modified: %v", web.Object)
+	}
+
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("Watch() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+// expireFirstWatch makes the first watch of dyn fail as if its
+// resourceVersion had been compacted away, after calling changes, if not
+// nil, to make changes it misses.
+func expireFirstWatch(dyn *fake.FakeDynamicClient, changes func()) {
+	var once sync.Once
+	dyn.PrependWatchReactor("*", func(action clienttesting.Action) (handled bool, w watch.Interface, err error) {
+		once.Do(func() {
+			if changes != nil {
+				changes()
+			}
+			fw := watch.NewFake()
+			go fw.Error(&apierrors.NewResourceExpired("too old resource version").ErrStatus)
+			handled, w = true, fw
+		})
+		return handled, w, nil
+	})
+}
+
+func TestWatchExpired(t *testing.T) {
+	a, b := configMap("a", "1"), configMap("b", "1")
+	a.SetResourceVersion("1")
+	b.SetResourceVersion("1")
+	c := newFakeClient(a, b)
+
+	dyn := c.dyn.(*fake.FakeDynamicClient)
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	tracker := dyn.Tracker()
+	expireFirstWatch(dyn, func() {
+		a2 := configMap("a", "2")
+		a2.SetResourceVersion("2")
+		tracker.Update(gvr, a2, "default")
+		tracker.Delete(gvr, "default", "b")
+		tracker.Create(gvr, configMap("c", "1"), "default")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	events := make(chan *Event)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Watch(ctx, Query{APIVersion: "v1", Kind: "ConfigMap"}, func(e *Event) {
+			events <- e
+		})
+	}()
+
+	// The objects are listed, then listed again once the watch expires,
+	// reporting the changes missed.
+	var got []string
+	for len(got) < 5 {
+		select {
+		case e := <-events:
+			got = append(got, e.String())
+		case err := <-errc:
+			t.Fatalf("Watch() returned early: %v", err)
+		}
+	}
+	sort.Strings(got[:2])
+	sort.Strings(got[2:])
+	want := []string{"ADDED configmap/a", "ADDED configmap/b", "ADDED configmap/c", "DELETED configmap/b", "MODIFIED configmap/a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("Watch() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestWatchQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		q    Query
+	}{
+		{"Missing kind", Query{APIVersion: "v1"}},
+		{"Bad selector", Query{APIVersion: "v1", Kind: "ConfigMap", Selector: "app in (web"}},
+		{"Unknown kind", Query{APIVersion: "example.com/v1", Kind: "Widget"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newFakeClient().Watch(context.Background(), tt.q, func(*Event) {})
+			if err == nil {
+				t.Errorf("Watch() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policy implements a declarative execution policy restricting what
+// websocket clients may run on the presentation server.
+//
+// A policy is loaded from a YAML file such as:
+//
+//	kinds: [run, saveFile, kubectlApply, kubectlDelete]
+//	interpreters: [/bin/sh, bash]
+//	saveFile:
+//	  directories: [/home/nonroot/presentation/work]
+//	kubectl:
+//	  namespaces: [default, demo]
+//	  resources: [Deployment, Service, Function]
+//	timeouts:
+//	  go: {wall: 30s, cpu: 10s}
+//	  terraform: {wall: 20m}
+//	  stream: {wall: 15m}
+//	sandbox:
+//	  shell: {cpus: 0.5, memory: 256Mi, pids: 64}
+//	  go: {cpus: 1, memory: 512Mi, pids: 128, tmpfs: 128Mi}
+//
+// Omitting a list leaves that aspect unrestricted, while an empty list
+// denies everything. A nil *Policy allows everything. Timeouts override the
+// server defaults for each run kind, and run kinds listed under sandbox run
+// inside a Linux sandbox with the given limits.
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rquitales/go-presentation-server/pkg/sandbox"
+	"sigs.k8s.io/yaml"
+)
+
+// Policy restricts the message kinds, interpreters, file paths and
+// Kubernetes objects a client may use.
+type Policy struct {
+	// Kinds are the enabled message kinds, eg: "run" or "kubectlApply".
+	Kinds []string `json:"kinds"`
+	// Interpreters are the allowed shebang interpreters, either as an
+	// absolute path or a bare command name matching any path.
+	Interpreters []string `json:"interpreters"`
+	SaveFile     struct {
+		// Directories saveFile may write into, including subdirectories.
+		Directories []string `json:"directories"`
+	} `json:"saveFile"`
+	Kubectl struct {
+		// Namespaces kubectl messages may touch. Objects without a
+		// namespace are checked in the Kubernetes client's namespace.
+		Namespaces []string `json:"namespaces"`
+		// Resources are the object kinds kubectl messages may touch.
+		Resources []string `json:"resources"`
+	} `json:"kubectl"`
+	// Timeouts are the default timeouts for each run kind ("shell", "go",
+	// "kubectl", "terraform" or "stream"). Streams, which watch objects or
+	// follow logs, have no timeout by default.
+	Timeouts map[string]Timeout `json:"timeouts"`
+	// Sandbox configures the sandbox for each run kind ("shell" or "go").
+	// Run kinds without an entry are not sandboxed.
+	Sandbox map[string]*sandbox.Config `json:"sandbox"`
+}
+
+// Timeout limits how long a process may run. Zero values use the server
+// defaults.
+type Timeout struct {
+	// Wall is the maximum wall-clock time.
+	Wall Duration `json:"wall"`
+	// CPU is the maximum CPU time.
+	CPU Duration `json:"cpu"`
+}
+
+// Duration is a time.Duration unmarshaled from a string such as "30s".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %s: want a string such as \"30s\"", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("invalid duration %q: must not be negative", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+var (
+	// runKinds are the kinds of process the server runs.
+	runKinds = []string{"shell", "go", "kubectl", "terraform", "stream"}
+	// sandboxKinds are the run kinds which may be sandboxed.
+	sandboxKinds = []string{"shell", "go"}
+)
+
+// Error is returned when a request is denied by the policy.
+type Error struct {
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return "policy: " + e.Reason
+}
+
+func deny(format string, args ...interface{}) error {
+	return &Error{Reason: fmt.Sprintf(format, args...)}
+}
+
+// Load reads a policy from a YAML file.
+func Load(path string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// Parse parses a YAML policy.
+func Parse(b []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.UnmarshalStrict(b, &p); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	for i, dir := range p.SaveFile.Directories {
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("invalid policy: saveFile directory must be absolute: %q", dir)
+		}
+		p.SaveFile.Directories[i] = resolve(dir)
+	}
+	for kind := range p.Timeouts {
+		if !contains(runKinds, kind) {
+			return nil, fmt.Errorf("invalid policy: unknown run kind %q, want one of %q", kind, runKinds)
+		}
+	}
+	for kind, cfg := range p.Sandbox {
+		if !contains(sandboxKinds, kind) {
+			return nil, fmt.Errorf("invalid policy: run kind %q cannot be sandboxed, want one of %q", kind, sandboxKinds)
+		}
+		if cfg == nil {
+			p.Sandbox[kind] = &sandbox.Config{}
+		}
+	}
+	return &p, nil
+}
+
+// AllowKind checks that the message kind is enabled.
+func (p *Policy) AllowKind(kind string) error {
+	if p == nil || p.Kinds == nil || contains(p.Kinds, kind) {
+		return nil
+	}
+	return deny("message kind %q is not enabled", kind)
+}
+
+// AllowInterpreter checks that a shebang interpreter may be run. For
+// "#!/usr/bin/env cmd" shebangs, cmd is checked instead of env.
+func (p *Policy) AllowInterpreter(path string, args []string) error {
+	if p == nil || p.Interpreters == nil {
+		return nil
+	}
+	if filepath.Base(path) == "env" && len(args) > 1 {
+		path = args[1]
+	}
+	for _, allowed := range p.Interpreters {
+		if allowed == path || (!strings.Contains(allowed, "/") && allowed == filepath.Base(path)) {
+			return nil
+		}
+	}
+	return deny("interpreter %q is not allowed", path)
+}
+
+// AllowSavePath checks that a file may be written to path.
+func (p *Policy) AllowSavePath(path string) error {
+	if p == nil || p.SaveFile.Directories == nil {
+		return nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if r, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = r
+	} else {
+		abs = filepath.Join(resolve(filepath.Dir(abs)), filepath.Base(abs))
+	}
+	for _, dir := range p.SaveFile.Directories {
+		if rel, err := filepath.Rel(dir, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return deny("saving files to %q is not allowed", path)
+}
+
+// AllowObjects checks that objects of a kind in a namespace, eg: to be
+// applied or watched, are allowed. An empty namespace is assumed to be "default".
+func (p *Policy) AllowObjects(kind, namespace string) error {
+	if p == nil {
+		return nil
+	}
+	if p.Kubectl.Resources != nil && !contains(p.Kubectl.Resources, kind) {
+		return deny("kubernetes resource kind %q is not allowed", kind)
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	if p.Kubectl.Namespaces != nil && !contains(p.Kubectl.Namespaces, namespace) {
+		return deny("kubernetes namespace %q is not allowed", namespace)
+	}
+	return nil
+}
+
+// TimeoutFor returns the timeouts configured for a run kind. Zero values
+// mean the server default should be used.
+func (p *Policy) TimeoutFor(kind string) Timeout {
+	if p == nil {
+		return Timeout{}
+	}
+	return p.Timeouts[kind]
+}
+
+// SandboxFor returns the sandbox configuration for a run kind, or nil if
+// it should not be sandboxed.
+func (p *Policy) SandboxFor(kind string) *sandbox.Config {
+	if p == nil {
+		return nil
+	}
+	return p.Sandbox[kind]
+}
+
+// resolve evaluates symlinks in path if it exists, so that policy checks
+// can't be bypassed through a link.
+func resolve(path string) string {
+	if r, err := filepath.EvalSymlinks(path); err == nil {
+		return r
+	}
+	return filepath.Clean(path)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
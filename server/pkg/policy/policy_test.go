@@ -0,0 +1,186 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPolicy = `
+kinds: [run, saveFile, kubectlApply]
+interpreters: [/bin/sh, bash]
+saveFile:
+  directories: [%s]
+kubectl:
+  namespaces: [default, demo]
+  resources: [Deployment, ConfigMap]
+`
+
+func loadTestPolicy(t *testing.T) (*Policy, string) {
+	dir, err := ioutil.TempDir("", "presentation-server-policy")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	p, err := Parse([]byte(fmt.Sprintf(testPolicy, dir)))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Parse() error = %v", err)
+	}
+	return p, dir
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr bool
+	}{
+		{"Empty policy", "", false},
+		{"Unknown field", "kind: [run]", true},
+		{"Relative saveFile directory", "saveFile:\n  directories: [work]", true},
+		{"Timeouts", "timeouts:\n  go: {wall: 30s, cpu: 10s}", false},
+		{"Stream timeout", "timeouts:\n  stream: {wall: 15m}", false},
+		{"Unknown timeout run kind", "timeouts:\n  python: {wall: 30s}", true},
+		{"Invalid timeout", "timeouts:\n  go: {wall: 30}", true},
+		{"Sandbox", "sandbox:\n  shell: {memory: 256Mi, pids: 64}", false},
+		{"Unsandboxable run kind", "sandbox:\n  kubectl: {}", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.policy))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAllowKind(t *testing.T) {
+	p, dir := loadTestPolicy(t)
+	defer os.RemoveAll(dir)
+
+	if err := p.AllowKind("run"); err != nil {
+		t.Errorf("AllowKind(run) error = %v", err)
+	}
+	err := p.AllowKind("terraformApply")
+	var perr *Error
+	if !errors.As(err, &perr) {
+		t.Errorf("AllowKind(terraformApply) error = %v, want *Error", err)
+	}
+
+	var none *Policy
+	if err := none.AllowKind("terraformApply"); err != nil {
+		t.Errorf("nil policy AllowKind() error = %v", err)
+	}
+	deny, _ := Parse([]byte("kinds: []"))
+	if err := deny.AllowKind("run"); err == nil {
+		t.Errorf("empty kinds AllowKind() allowed run")
+	}
+}
+
+func TestAllowInterpreter(t *testing.T) {
+	p, dir := loadTestPolicy(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		shebang []string
+		wantErr bool
+	}{
+		{[]string{"/bin/sh"}, false},
+		{[]string{"/usr/bin/sh"}, true},
+		{[]string{"/usr/local/bin/bash"}, false},
+		{[]string{"/usr/bin/env", "bash"}, false},
+		{[]string{"/usr/bin/env", "python3"}, true},
+		{[]string{"/usr/bin/python3"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(filepath.Join(tt.shebang...), func(t *testing.T) {
+			err := p.AllowInterpreter(tt.shebang[0], tt.shebang)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("AllowInterpreter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAllowSavePath(t *testing.T) {
+	p, dir := loadTestPolicy(t)
+	defer os.RemoveAll(dir)
+
+	outside, err := ioutil.TempDir("", "presentation-server-policy")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"In directory", filepath.Join(dir, "main.go"), false},
+		{"In subdirectory", filepath.Join(dir, "api", "v1", "types.go"), false},
+		{"Outside directory", filepath.Join(outside, "main.go"), true},
+		{"Parent traversal", filepath.Join(dir, "..", "main.go"), true},
+		{"Through symlink", filepath.Join(link, "main.go"), true},
+		{"Prefix sibling", dir + "-other/main.go", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.AllowSavePath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("AllowSavePath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAllowObjects(t *testing.T) {
+	p, dir := loadTestPolicy(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name      string
+		kind      string
+		namespace string
+		wantErr   bool
+	}{
+		{"Default namespace", "Deployment", "", false},
+		{"Allowed namespace", "ConfigMap", "demo", false},
+		{"Disallowed namespace", "ConfigMap", "kube-system", true},
+		{"Disallowed kind", "Secret", "demo", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.AllowObjects(tt.kind, tt.namespace)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("AllowObjects(%q, %q) error = %v, wantErr %v", tt.kind, tt.namespace, err, tt.wantErr)
+			}
+		})
+	}
+	var nilPolicy *Policy
+	if err := nilPolicy.AllowObjects("Secret", "kube-system"); err != nil {
+		t.Errorf("nil policy denied objects: %v", err)
+	}
+}
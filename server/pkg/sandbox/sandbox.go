@@ -0,0 +1,103 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sandbox runs commands isolated from the host, so that a bad code
+// snippet during a live talk cannot take down the presentation server.
+//
+// Sandboxed commands run in new user, mount, PID, network, IPC and UTS
+// namespaces with a read-only view of the host filesystem and a scratch
+// tmpfs mounted on /tmp. CPU, memory and process count limits are applied
+// through a cgroup v2.
+//
+// The mounts are set up by re-executing the server binary as the sandbox
+// init, so main must call Init before doing anything else.
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Config describes the sandbox a command runs in. Zero values leave the
+// corresponding limit unset.
+type Config struct {
+	// CPUs is the number of CPUs the command may use, eg: 0.5.
+	CPUs float64 `json:"cpus"`
+	// Memory is the maximum memory in bytes, including the scratch tmpfs.
+	Memory Size `json:"memory"`
+	// Pids is the maximum number of processes.
+	Pids int `json:"pids"`
+	// Tmpfs is the size of the scratch tmpfs mounted on /tmp. Defaults to
+	// 64Mi.
+	Tmpfs Size `json:"tmpfs"`
+	// Cgroup is the cgroup v2 directory under which a cgroup is created for
+	// each command. It must be delegated to the server user. Defaults to
+	// the cgroup of the server.
+	Cgroup string `json:"cgroup"`
+}
+
+// hasLimits reports whether the config requires a cgroup.
+func (c *Config) hasLimits() bool {
+	return c.CPUs > 0 || c.Memory > 0 || c.Pids > 0
+}
+
+// Size is a number of bytes. It is unmarshaled from either a number or a
+// string with an optional binary suffix, eg: "256Mi" or "1G".
+type Size int64
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Size) UnmarshalJSON(b []byte) error {
+	var n int64
+	if err := json.Unmarshal(b, &n); err == nil {
+		*s = Size(n)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return fmt.Errorf("invalid size: %s", b)
+	}
+	v, err := ParseSize(str)
+	if err != nil {
+		return err
+	}
+	*s = v
+	return nil
+}
+
+// ParseSize parses a size such as "512", "64Ki", "256M" or "1Gi". Suffixes
+// are always binary, so "1M" and "1Mi" are both 1048576 bytes.
+func ParseSize(str string) (Size, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"K", 1 << 10},
+		{"M", 1 << 20},
+		{"G", 1 << 30},
+	}
+	num, mult := strings.TrimSpace(str), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix+"i") || strings.HasSuffix(num, u.suffix) {
+			num, mult = strings.TrimSuffix(strings.TrimSuffix(num, "i"), u.suffix), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %q", str)
+	}
+	return Size(n * mult), nil
+}
@@ -0,0 +1,364 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sandbox
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+// Environment variables used to pass the sandbox setup to Init.
+const (
+	initEnv  = "PRESENT_SANDBOX_INIT"
+	tmpfsEnv = "PRESENT_SANDBOX_TMPFS"
+	keepEnv  = "PRESENT_SANDBOX_KEEP"
+)
+
+const defaultTmpfs = 64 << 20
+
+// Command configures cmd, which must not have been started yet, to run
+// inside a sandbox described by cfg. The directories in keep remain
+// visible (read-only) even if they live under /tmp, eg: the directory
+// holding a built binary.
+// The returned cleanup func must be called once cmd has exited.
+func Command(cmd *exec.Cmd, cfg *Config, keep ...string) (cleanup func(), err error) {
+	if cmd.Process != nil {
+		return nil, errors.New("sandbox: command already started")
+	}
+	cleanup = func() {}
+
+	tmpfs := cfg.Tmpfs
+	if tmpfs == 0 {
+		tmpfs = defaultTmpfs
+	}
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env[:len(env):len(env)],
+		initEnv+"=1",
+		fmt.Sprintf("%s=%d", tmpfsEnv, tmpfs),
+		keepEnv+"="+strings.Join(keep, string(filepath.ListSeparator)),
+	)
+	// Re-exec the server binary as the sandbox init, which execs the
+	// original command once the mounts are in place.
+	cmd.Args = append([]string{"present-sandbox", cmd.Path}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+
+	attr := cmd.SysProcAttr
+	if attr == nil {
+		attr = &syscall.SysProcAttr{}
+	}
+	attr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+		syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	// Map root in the sandbox to the server user, giving init the
+	// capabilities it needs to mount within its namespaces only.
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	attr.GidMappingsEnableSetgroups = false
+	cmd.SysProcAttr = attr
+
+	if !cfg.hasLimits() {
+		return cleanup, nil
+	}
+	cg, err := newCgroup(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("sandbox: %w", err)
+	}
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(cg.Fd())
+	return func() {
+		cg.Close()
+		removeCgroup(cg.Name())
+	}, nil
+}
+
+// newCgroup creates a cgroup with the limits in cfg, returning it opened
+// as a directory so the command can be started directly inside it.
+func newCgroup(cfg *Config) (*os.File, error) {
+	parent := cfg.Cgroup
+	if parent == "" {
+		var err error
+		if parent, err = ownCgroup(); err != nil {
+			return nil, err
+		}
+	}
+	// Enabling the controllers may fail if they already are, or if the
+	// parent isn't delegated; writing the limits below reports the latter.
+	ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0)
+
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(parent, "present-"+hex.EncodeToString(b))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create cgroup: %w", err)
+	}
+
+	limits := map[string]string{}
+	if cfg.CPUs > 0 {
+		const period = 100000
+		limits["cpu.max"] = fmt.Sprintf("%d %d", int64(cfg.CPUs*period), period)
+	}
+	if cfg.Memory > 0 {
+		limits["memory.max"] = fmt.Sprint(int64(cfg.Memory))
+		limits["memory.swap.max"] = "0"
+	}
+	if cfg.Pids > 0 {
+		limits["pids.max"] = fmt.Sprint(cfg.Pids)
+	}
+	for file, v := range limits {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(v), 0); err != nil {
+			if file == "memory.swap.max" && os.IsNotExist(err) {
+				continue // swap accounting disabled
+			}
+			os.Remove(dir)
+			return nil, fmt.Errorf("unable to set cgroup limit %s: %w", file, err)
+		}
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+	return f, nil
+}
+
+// removeCgroup removes a cgroup once the processes in it have gone. The
+// sandbox init has exited, but the kernel may still be reaping the rest of
+// its PID namespace.
+func removeCgroup(dir string) {
+	for i := 0; i < 50; i++ {
+		if err := os.Remove(dir); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// ownCgroup returns the cgroup v2 directory of the current process.
+func ownCgroup() (string, error) {
+	root, err := cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return filepath.Join(root, strings.TrimPrefix(line, "0::")), nil
+		}
+	}
+	return "", errors.New("not in a cgroup v2 hierarchy")
+}
+
+// cgroup2Mount returns where the cgroup v2 hierarchy is mounted.
+func cgroup2Mount() (string, error) {
+	mounts, err := mountInfo()
+	if err != nil {
+		return "", err
+	}
+	for _, m := range mounts {
+		if m.fstype == "cgroup2" {
+			return m.point, nil
+		}
+	}
+	return "", errors.New("cgroup v2 is not mounted")
+}
+
+type mount struct {
+	point  string
+	opts   []string
+	fstype string
+}
+
+// mountInfo parses /proc/self/mountinfo.
+func mountInfo() ([]mount, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []mount
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(s.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 6 || sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+		mounts = append(mounts, mount{
+			point:  unescape(fields[4]),
+			opts:   strings.Split(fields[5], ","),
+			fstype: fields[sep+1],
+		})
+	}
+	return mounts, s.Err()
+}
+
+// unescape decodes the octal escapes used for spaces and other special
+// characters in /proc/self/mountinfo.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			var c byte
+			if _, err := fmt.Sscanf(s[i+1:i+4], "%03o", &c); err == nil {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Init sets up the sandbox and execs the sandboxed command if the current
+// process was started by Command. Otherwise it returns immediately. It must
+// be called at the start of main.
+func Init() {
+	if os.Getenv(initEnv) != "1" {
+		return
+	}
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, "sandbox: missing command")
+		os.Exit(125)
+	}
+	if err := setup(); err != nil {
+		fmt.Fprintln(os.Stderr, "sandbox:", err)
+		os.Exit(125)
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "PRESENT_SANDBOX_") {
+			env = append(env, kv)
+		}
+	}
+	err := syscall.Exec(os.Args[1], os.Args[2:], env)
+	fmt.Fprintln(os.Stderr, "sandbox:", err)
+	os.Exit(127)
+}
+
+// setup makes the filesystem read-only, mounts the scratch tmpfs and a
+// fresh /proc for the new PID namespace.
+func setup() error {
+	wd, _ := os.Getwd()
+
+	// Stop our mounts from propagating back to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("unable to make mounts private: %w", err)
+	}
+
+	// Hold on to the directories to keep before /tmp is hidden, so that
+	// they can be bind mounted back into place afterwards.
+	var keep []*os.File
+	for _, dir := range filepath.SplitList(os.Getenv(keepEnv)) {
+		f, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		keep = append(keep, f)
+	}
+
+	mounts, err := mountInfo()
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		err := remountReadOnly(m)
+		if err != nil && m.point == "/" {
+			return fmt.Errorf("unable to make root read-only: %w", err)
+		}
+	}
+
+	tmpfs := os.Getenv(tmpfsEnv)
+	if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777,size="+tmpfs); err != nil {
+		return fmt.Errorf("unable to mount scratch tmpfs: %w", err)
+	}
+	for _, f := range keep {
+		dir := f.Name()
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		src := fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+		if err := syscall.Mount(src, dir, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("unable to mount %s: %w", dir, err)
+		}
+		syscall.Mount("", dir, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, "")
+	}
+
+	if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("unable to mount /proc: %w", err)
+	}
+
+	os.Setenv("HOME", "/tmp")
+	os.Setenv("TMPDIR", "/tmp")
+	if wd == "" || os.Chdir(wd) != nil {
+		return os.Chdir("/tmp")
+	}
+	return nil
+}
+
+// remountReadOnly remounts m read-only, preserving the flags the kernel
+// won't let an unprivileged user namespace clear.
+func remountReadOnly(m mount) error {
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for _, o := range m.opts {
+		switch o {
+		case "nosuid":
+			flags |= syscall.MS_NOSUID
+		case "nodev":
+			flags |= syscall.MS_NODEV
+		case "noexec":
+			flags |= syscall.MS_NOEXEC
+		case "noatime":
+			flags |= syscall.MS_NOATIME
+		case "nodiratime":
+			flags |= syscall.MS_NODIRATIME
+		case "relatime":
+			flags |= syscall.MS_RELATIME
+		}
+	}
+	return syscall.Mount("", m.point, "", flags, "")
+}
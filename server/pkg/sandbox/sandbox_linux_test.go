@@ -0,0 +1,118 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sandbox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+func TestMain(m *testing.M) {
+	// The test binary is re-executed as the sandbox init.
+	Init()
+	os.Exit(m.Run())
+}
+
+// userns reports whether unprivileged user namespaces can be created.
+func userns(t *testing.T) {
+	cmd := exec.Command("/bin/true")
+	if _, err := Command(cmd, &Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Run(); err != nil {
+		t.Skipf("user namespaces unavailable: %v", err)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	userns(t)
+
+	dir, err := ioutil.TempDir("", "presentation-server-sandbox")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "kept"), []byte("kept"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	script := `
+echo pid=$$
+cat ` + filepath.Join(dir, "kept") + `; echo
+touch /etc/present-sandbox 2>/dev/null && echo root=rw || echo root=ro
+touch /tmp/scratch && echo tmp=rw
+touch ` + filepath.Join(dir, "new") + ` 2>/dev/null && echo keep=rw || echo keep=ro
+cat /proc/net/dev
+`
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cleanup, err := Command(cmd, &Config{}, dir)
+	if err != nil {
+		t.Fatalf("Command() error = %v", err)
+	}
+	defer cleanup()
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v: %s", err, out.String())
+	}
+
+	got := out.String()
+	for _, want := range []string{"pid=1\n", "kept\n", "root=ro\n", "tmp=rw\n", "keep=ro\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("sandbox output missing %q:\n%s", want, got)
+		}
+	}
+	if _, err := os.Stat("/tmp/scratch"); err == nil {
+		t.Errorf("scratch file leaked onto the host /tmp")
+	}
+	if strings.Contains(got, "eth") {
+		t.Errorf("sandbox has host network interfaces:\n%s", got)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Size
+		wantErr bool
+	}{
+		{"512", 512, false},
+		{"64Ki", 64 << 10, false},
+		{"256M", 256 << 20, false},
+		{"1Gi", 1 << 30, false},
+		{"1.5G", 0, true},
+		{"-1", 0, true},
+		{"12i", 0, true},
+		{"lots", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSize(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package sandbox
+
+import (
+	"errors"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+// Command always fails, as sandboxing requires Linux namespaces.
+func Command(cmd *exec.Cmd, cfg *Config, keep ...string) (cleanup func(), err error) {
+	return nil, errors.New("sandbox: not supported on this platform")
+}
+
+// Init does nothing on this platform.
+func Init() {}
@@ -15,47 +15,196 @@
 package server
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/rquitales/go-presentation-server/client/crd"
 	"github.com/rquitales/go-presentation-server/pkg/filepath"
+	"github.com/rquitales/go-presentation-server/pkg/k8s"
 	"github.com/rquitales/go-presentation-server/pkg/kubectl"
+	"github.com/rquitales/go-presentation-server/pkg/policy"
 	"github.com/rquitales/go-presentation-server/pkg/socket"
 )
 
+// Options configure the presentation server.
+type Options struct {
+	// Folder is the path to the static assets to serve.
+	Folder string
+	// Address is the address to serve on.
+	Address string
+	// AllowedOrigins are additional websocket origins to accept.
+	AllowedOrigins []string
+	// TokenFile is an optional file containing the presenter token.
+	TokenFile string
+	// PolicyFile is an optional YAML execution policy.
+	PolicyFile string
+	// GoCache is the directory for the Go build and module caches, and
+	// built snippets. Defaults to a directory in the user cache directory.
+	GoCache string
+	// GoOffline stops Go snippets from downloading modules.
+	GoOffline bool
+	// GoModules is an optional directory of modules, laid out like a module
+	// proxy, for building Go snippets offline.
+	GoModules string
+	// Record is an optional directory to record the output of every
+	// snippet run to.
+	Record string
+	// Replay is an optional directory of recordings to replay instead of
+	// running snippets.
+	Replay string
+	// ResumeGrace is how long snippets keep running after the presenter's
+	// connection drops, for a new connection to resume their output.
+	ResumeGrace time.Duration
+}
+
+// tokenEnv is the environment variable that may hold the presenter token.
+const tokenEnv = "PRESENT_TOKEN"
+
 // Serve creates a simple file server for a specified folder and serving
 // address. A websocket endpoint is also created for the handling of code
-// execution.
-func Serve(path string, addr string) {
-	pathToServe, err := filepath.IsFolder(path)
+// execution, accepting connections from the serving address and any of the
+// allowed origins.
+func Serve(opts Options) {
+	pathToServe, err := filepath.IsFolder(opts.Folder)
 	if err != nil {
 		log.Fatalf("Unable to get static file path: %s", err)
 	}
 
-	log.Printf("Serving presentation at: %s\n", addr)
+	token, generated, err := presenterToken(opts.TokenFile)
+	if err != nil {
+		log.Fatalf("Unable to get presenter token: %s", err)
+	}
+
+	var pol *policy.Policy
+	if opts.PolicyFile != "" {
+		pol, err = policy.Load(opts.PolicyFile)
+		if err != nil {
+			log.Fatalf("Unable to load policy: %s", err)
+		}
+		log.Printf("Loaded execution policy from: %s\n", opts.PolicyFile)
+	}
+
+	if opts.GoCache == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			log.Fatalf("Unable to find go cache directory: %s", err)
+		}
+		opts.GoCache = dir + string(os.PathSeparator) + "present"
+	}
+
+	log.Printf("Serving presentation at: %s\n", opts.Address)
+	if generated {
+		log.Printf("Presenter URL: http://%s/?%s=%s\n", opts.Address, socket.TokenParam, token)
+	}
 
 	mux := http.NewServeMux()
 	server := &http.Server{
-		Addr:    addr,
+		Addr:    opts.Address,
 		Handler: mux,
 	}
 	origin := &url.URL{
 		Scheme: "http",
-		Host:   addr,
+		Host:   opts.Address,
+	}
+
+	var recordings *socket.Recordings
+	if opts.Record != "" && opts.Replay != "" {
+		log.Fatalf("Unable to both record and replay snippets")
+	}
+	if opts.Record != "" {
+		recordings, err = socket.NewRecordings(opts.Record, false)
+		if err != nil {
+			log.Fatalf("Unable to record snippets: %s", err)
+		}
+		log.Printf("Recording snippets to: %s\n", opts.Record)
+	}
+	if opts.Replay != "" {
+		recordings, err = socket.NewRecordings(opts.Replay, true)
+		if err != nil {
+			log.Fatalf("Unable to replay snippets: %s", err)
+		}
+		log.Printf("Replaying snippets from: %s\n", opts.Replay)
+	}
+
+	artifacts, err := socket.NewArtifacts(opts.GoCache + string(os.PathSeparator) + "artifacts")
+	if err != nil {
+		log.Fatalf("Unable to create artifact store: %s", err)
+	}
+
+	kube, err := k8s.NewFromKubeconfig()
+	if err != nil {
+		// Slides may well not use Kubernetes.
+		log.Printf("Unable to configure Kubernetes client, kubectl snippets will fail: %s", err)
+	}
+
+	transcripts := socket.NewTranscripts()
+	handler, err := socket.NewHandler(socket.Config{
+		Origin:         origin,
+		AllowedOrigins: opts.AllowedOrigins,
+		Token:          token,
+		Policy:         pol,
+		Go: socket.GoBuild{
+			CacheDir:  opts.GoCache,
+			Offline:   opts.GoOffline,
+			Modules:   opts.GoModules,
+			Artifacts: artifacts,
+		},
+		Recordings:  recordings,
+		Transcripts: transcripts,
+		ResumeGrace: opts.ResumeGrace,
+		Kubernetes:  kube,
+	})
+	if err != nil {
+		log.Fatalf("Unable to create websocket handler: %s", err)
 	}
 
 	// Handles code execution.
-	mux.Handle("/socket", socket.NewHandler(origin))
+	mux.Handle("/socket", handler)
+	// Serves Go snippets built for other platforms, eg: WebAssembly.
+	mux.Handle(socket.ArtifactPath, http.StripPrefix(socket.ArtifactPath, artifacts))
+	// Exports what was run, for presenters only.
+	mux.Handle(socket.TranscriptPath, socket.RequireToken(token, http.StripPrefix(socket.TranscriptPath, transcripts)))
 	mux.HandleFunc("/crd/", handleCRD)
-	mux.Handle("/", http.FileServer(http.Dir(pathToServe)))
+	mux.Handle("/", socket.RememberToken(token, http.FileServer(http.Dir(pathToServe))))
 
 	log.Println(server.ListenAndServe())
 }
 
+// presenterToken returns the token presenters must provide to run code. It
+// is read from tokenFile if set, then from the PRESENT_TOKEN environment
+// variable, and otherwise randomly generated.
+func presenterToken(tokenFile string) (token string, generated bool, err error) {
+	if tokenFile != "" {
+		b, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return "", false, err
+		}
+		token = strings.TrimSpace(string(b))
+		if token == "" {
+			return "", false, fmt.Errorf("token file is empty: %q", tokenFile)
+		}
+		return token, false, nil
+	}
+	if token = os.Getenv(tokenEnv); token != "" {
+		return token, false, nil
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", false, err
+	}
+	return hex.EncodeToString(b), true, nil
+}
+
 func handleCRD(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get("name")
 	if name != "" {
@@ -0,0 +1,125 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+// ArtifactPath is the URL path that built artifacts are served under.
+const ArtifactPath = "/artifact/"
+
+// wasmExec is the name of the JavaScript support file needed to run Go
+// WebAssembly modules, served alongside them.
+const wasmExec = "wasm_exec.js"
+
+// Artifacts stores the binaries built for other platforms, such as
+// WebAssembly modules, and serves them for download. Artifacts are named
+// after the hash of their contents, so they can only be fetched by clients
+// told their name in an "end" message.
+type Artifacts struct {
+	dir string
+
+	once     sync.Once
+	wasmExec string // path of wasm_exec.js, if found
+}
+
+// NewArtifacts returns an artifact store keeping its files in dir.
+func NewArtifacts(dir string) (*Artifacts, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create artifact directory: %w", err)
+	}
+	return &Artifacts{dir: dir}, nil
+}
+
+// add copies the binary bin into the store, returning the URL path it is
+// served at.
+func (a *Artifacts) add(bin string) (string, error) {
+	f, err := os.Open(bin)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	tmp, err := ioutil.TempFile(a.dir, "tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), f)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(h.Sum(nil)) + filepath.Ext(bin)
+	if err := os.Rename(tmp.Name(), filepath.Join(a.dir, name)); err != nil {
+		return "", err
+	}
+	return ArtifactPath + name, nil
+}
+
+// ServeHTTP serves the artifact named by the request path, which must have
+// ArtifactPath stripped, and the go command's wasm_exec.js.
+func (a *Artifacts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path
+	if name == wasmExec {
+		path := a.findWasmExec()
+		if path == "" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, path)
+		return
+	}
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "tmp-") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "prog"+filepath.Ext(name)))
+	http.ServeFile(w, r, filepath.Join(a.dir, name))
+}
+
+// findWasmExec returns the path of the wasm_exec.js shipped with the go
+// command, which moved from misc/wasm to lib/wasm in Go 1.24.
+func (a *Artifacts) findWasmExec() string {
+	a.once.Do(func() {
+		out, err := exec.Command("go", "env", "GOROOT").Output()
+		if err != nil {
+			return
+		}
+		root := strings.TrimSpace(string(out))
+		for _, dir := range []string{"lib", "misc"} {
+			path := filepath.Join(root, dir, "wasm", wasmExec)
+			if _, err := os.Stat(path); err == nil {
+				a.wasmExec = path
+				return
+			}
+		}
+	})
+	return a.wasmExec
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+func TestCrossCompile(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	a, err := NewArtifacts(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.StripPrefix(ArtifactPath, a))
+	defer srv.Close()
+	const prog = "package main\n\nfunc main() { println(\"hello\") }\n"
+
+	tests := []struct {
+		name      string
+		opt       *Options
+		store     *Artifacts
+		wantEnd   string
+		wantExt   string // of the artifact, if one is built
+		wantMagic string // at the start of the artifact
+	}{
+		{"Host", &Options{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}, a, "", "", ""},
+		{"WebAssembly", &Options{GOOS: "js", GOARCH: "wasm"}, a, "", ".wasm", "\x00asm"},
+		{"Windows", &Options{GOOS: "windows", GOARCH: "amd64"}, a, "", ".exe", "MZ"},
+		{"Not enabled", &Options{GOOS: "js", GOARCH: "wasm"}, nil, "building for js/wasm is not enabled", "", ""},
+		{"Unsupported", &Options{GOOS: "plan9", GOARCH: "wasm"}, a, "exit status 2", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := make(chan *Message)
+			startProcess("t", prog, dest, tt.opt, "", nil, &goBuilder{store: tt.store})
+			var end *Message
+			timeout := time.After(time.Minute)
+			for end == nil {
+				select {
+				case m := <-dest:
+					if m.Kind == "end" {
+						end = m
+					}
+				case <-timeout:
+					t.Fatal("process did not end")
+				}
+			}
+			if !strings.HasPrefix(end.Body, tt.wantEnd) || (tt.wantEnd == "" && end.Body != "") {
+				t.Fatalf("got end %q, want %q", end.Body, tt.wantEnd)
+			}
+			if tt.wantEnd == "" && end.Exit.Size == 0 {
+				t.Error("binary size not reported")
+			}
+			if tt.wantExt == "" {
+				if end.Exit.Artifact != "" {
+					t.Errorf("got artifact %q, want none", end.Exit.Artifact)
+				}
+				return
+			}
+			if !strings.HasPrefix(end.Exit.Artifact, ArtifactPath) || filepath.Ext(end.Exit.Artifact) != tt.wantExt {
+				t.Fatalf("got artifact %q, want %s*%s", end.Exit.Artifact, ArtifactPath, tt.wantExt)
+			}
+			resp, err := http.Get(srv.URL + end.Exit.Artifact)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			b, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || int64(len(b)) != end.Exit.Size || !strings.HasPrefix(string(b), tt.wantMagic) {
+				t.Errorf("got status %d with %d bytes starting %q, want %d bytes starting %q", resp.StatusCode, len(b), b[:4], end.Exit.Size, tt.wantMagic)
+			}
+		})
+	}
+}
+
+func TestArtifactsServe(t *testing.T) {
+	dir := t.TempDir()
+	a, err := NewArtifacts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "prog.wasm")
+	ioutil.WriteFile(src, []byte("\x00asm"), 0644)
+	path, err := a.add(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "tmp-123"), nil, 0644)
+
+	tests := []struct {
+		path     string
+		wantCode int
+		wantType string
+	}{
+		{path, http.StatusOK, "application/wasm"},
+		{ArtifactPath + "missing.wasm", http.StatusNotFound, ""},
+		{ArtifactPath + "tmp-123", http.StatusNotFound, ""},
+		{ArtifactPath + "..%2fsecret", http.StatusNotFound, ""},
+		{ArtifactPath, http.StatusNotFound, ""},
+		{ArtifactPath + wasmExec, http.StatusOK, "text/javascript; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if _, err := exec.LookPath("go"); err != nil && strings.HasSuffix(tt.path, wasmExec) {
+				t.Skip("go command not found")
+			}
+			rec := httptest.NewRecorder()
+			http.StripPrefix(ArtifactPath, a).ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Content-Type"); tt.wantType != "" && got != tt.wantType {
+				t.Errorf("got content type %q, want %q", got, tt.wantType)
+			}
+		})
+	}
+}
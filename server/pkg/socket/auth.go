@@ -0,0 +1,115 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+const (
+	// TokenParam is the query parameter carrying the presenter token.
+	TokenParam = "token"
+	// TokenCookie is the cookie carrying the presenter token.
+	TokenCookie = "present_token"
+	// SessionParam is the query parameter naming the presentation session
+	// a connection joins. Audience connections receive the output of the
+	// processes run by presenters in the same session.
+	SessionParam = "session"
+
+	roleParam = "role"
+)
+
+// role is the permission level of a websocket connection.
+type role string
+
+const (
+	// presenter connections may start and kill processes.
+	presenter role = "presenter"
+	// audience connections are read-only and only receive the output of
+	// processes started by presenters.
+	audience role = "audience"
+)
+
+var (
+	errMissingToken = errors.New("missing presenter token")
+	errBadToken     = errors.New("invalid presenter token")
+	errReadOnly     = errors.New("permission denied: audience connections cannot start processes")
+)
+
+// requestToken returns the presenter token sent with the request, either as
+// a query parameter or a cookie.
+func requestToken(req *http.Request) string {
+	if t := req.URL.Query().Get(TokenParam); t != "" {
+		return t
+	}
+	if c, err := req.Cookie(TokenCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// validToken reports whether got matches the presenter token.
+func validToken(token, got string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(got)) == 1
+}
+
+// authenticate returns the role of the request. Presenters must provide the
+// presenter token, while connections asking for the audience role with
+// "?role=audience" need no token.
+func authenticate(token string, req *http.Request) (role, error) {
+	got := requestToken(req)
+	switch {
+	case got != "" && !validToken(token, got):
+		return "", errBadToken
+	case got != "":
+		return presenter, nil
+	case req.URL.Query().Get(roleParam) == string(audience):
+		return audience, nil
+	}
+	return "", errMissingToken
+}
+
+// RememberToken wraps next so that visiting any page with a valid presenter
+// token in the query string stores it in a cookie. Websocket connections
+// opened by those pages then authenticate as presenter without the slides
+// having to pass the token along themselves.
+func RememberToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t := r.URL.Query().Get(TokenParam); validToken(token, t) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     TokenCookie,
+				Value:    t,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireToken wraps next so that only requests with a valid presenter
+// token, in the query string or cookie, are served.
+func RequireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validToken(token, requestToken(r)) {
+			http.Error(w, errBadToken.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,205 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const testToken = "s3cret"
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		cookie  string
+		want    role
+		wantErr bool
+	}{
+		{"Token query parameter", "/socket?token=s3cret", "", presenter, false},
+		{"Token cookie", "/socket", "s3cret", presenter, false},
+		{"Bad token", "/socket?token=guess", "", "", true},
+		{"Bad token with audience role", "/socket?token=guess&role=audience", "", "", true},
+		{"Audience role", "/socket?role=audience", "", audience, false},
+		{"Missing token", "/socket", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: TokenCookie, Value: tt.cookie})
+			}
+			got, err := authenticate(testToken, req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("authenticate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		cookie string
+		want   int
+	}{
+		{"Token query parameter", "/transcript/?token=s3cret", "", http.StatusOK},
+		{"Token cookie", "/transcript/", "s3cret", http.StatusOK},
+		{"Bad token", "/transcript/?token=guess", "", http.StatusUnauthorized},
+		{"Audience role", "/transcript/?role=audience", "", http.StatusUnauthorized},
+		{"Missing token", "/transcript/", "", http.StatusUnauthorized},
+	}
+	h := RequireToken(testToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: TokenCookie, Value: tt.cookie})
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("got status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+// newTestServer starts a websocket server and returns a function dialing it
+// with the given query string.
+func newTestServer(t *testing.T) (dial func(query string) (*websocket.Conn, error), cleanup func()) {
+	return newTestServerConfig(t, Config{})
+}
+
+// newTestServerConfig is like newTestServer, with the rest of the handler
+// configured by cfg.
+func newTestServerConfig(t *testing.T, cfg Config) (dial func(query string) (*websocket.Conn, error), cleanup func()) {
+	srv := httptest.NewUnstartedServer(nil)
+	origin := &url.URL{Scheme: "http", Host: srv.Listener.Addr().String()}
+	cfg.Origin, cfg.Token = origin, testToken
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatalf("NewHandler() error = %v", err)
+	}
+	srv.Config.Handler = h
+	srv.Start()
+
+	dial = func(query string) (*websocket.Conn, error) {
+		u := "ws://" + origin.Host + "/socket?" + query
+		return websocket.Dial(u, "", origin.String())
+	}
+	return dial, srv.Close
+}
+
+func TestAudienceBroadcast(t *testing.T) {
+	dial, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if _, err := dial(""); err == nil {
+		t.Fatal("connection without token was accepted")
+	}
+
+	viewer, err := dial("role=audience")
+	if err != nil {
+		t.Fatalf("dial audience: %v", err)
+	}
+	defer viewer.Close()
+	viewer.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// Audience connections cannot start processes.
+	websocket.JSON.Send(viewer, &Message{Id: "a", Kind: "run", Body: "#!/bin/sh\necho hi"})
+	var m Message
+	if err := websocket.JSON.Receive(viewer, &m); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if m.Id != "a" || m.Kind != "end" || m.Body != errReadOnly.Error() {
+		t.Fatalf("audience run got %+v, want permission denied end message", m)
+	}
+
+	// But they receive the output of presenter runs.
+	pres, err := dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("dial presenter: %v", err)
+	}
+	defer pres.Close()
+	websocket.JSON.Send(pres, &Message{Id: "p", Kind: "run", Body: "#!/bin/sh\necho hello"})
+
+	var out strings.Builder
+	for m.Kind != "end" || m.Id != "p" {
+		m = Message{}
+		if err := websocket.JSON.Receive(viewer, &m); err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		if m.Kind == "stdout" {
+			out.WriteString(m.Body)
+		}
+	}
+	if got := out.String(); got != "hello\n" {
+		t.Errorf("audience stdout = %q, want %q", got, "hello\n")
+	}
+}
+
+func TestAudienceSessions(t *testing.T) {
+	dial, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// Two talks given at once, each followed by its own audience.
+	viewers := make(map[string]*websocket.Conn)
+	for _, session := range []string{"kubecon", "gophercon", ""} {
+		viewer, err := dial("role=audience&session=" + session)
+		if err != nil {
+			t.Fatalf("dial audience of %q: %v", session, err)
+		}
+		defer viewer.Close()
+		viewers[session] = viewer
+	}
+	for _, session := range []string{"kubecon", "gophercon", ""} {
+		pres, err := dial("token=" + testToken + "&session=" + session)
+		if err != nil {
+			t.Fatalf("dial presenter of %q: %v", session, err)
+		}
+		defer pres.Close()
+		websocket.JSON.Send(pres, &Message{Id: "p", Kind: "run", Body: "#!/bin/sh\necho " + session})
+		receiveUntilEnd(t, pres, "p")
+	}
+
+	tests := []struct {
+		session string
+		want    string
+	}{
+		{"kubecon", "kubecon\n"},
+		{"gophercon", "gophercon\n"},
+		{"", "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.session, func(t *testing.T) {
+			// Only the output of the first run reaches each audience.
+			if out, _ := receiveUntilEnd(t, viewers[tt.session], "p"); out != tt.want {
+				t.Errorf("audience stdout = %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/scanner"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rquitales/go-presentation-server/pkg/policy"
+	exec "golang.org/x/sys/execabs"
+)
+
+// Diagnostic is a problem found in a Go file, sent in "diagnostic"
+// messages so that editors can underline it.
+type Diagnostic struct {
+	File     string // name of the file in the txtar archive
+	Line     int
+	Column   int `json:",omitempty"`
+	Message  string
+	Source   string // "gofmt", "vet" or "compile"
+	Severity string // "error" or "warning"
+}
+
+func (d *Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+}
+
+var errSyntax = errors.New("syntax errors found by gofmt")
+
+// startCheck runs gofmt and go vet on the Go files in a txtar archive,
+// sending the problems found and end event as Messages on the provided
+// channel.
+func startCheck(id, body string, dest chan<- *Message, opt *Options, pol *policy.Policy, gb *goBuilder) *process {
+	p := newProcess(id, golang, dest, opt, pol)
+	p.goBuild = gb
+	p.background(opt, func() error { return p.startCheck(body) })
+	return p
+}
+
+// startCheck checks the archive, returning an error if any problem was
+// found.
+func (p *process) startCheck(body string) error {
+	path, err := ioutil.TempDir("", "present-check-")
+	if err != nil {
+		return err
+	}
+	p.path = path // to be removed by p.end
+
+	hasModfile, err := writeArchive(path, body, "prog.go")
+	if err != nil {
+		return err
+	}
+	if err := p.check(path, hasModfile); err != nil {
+		return err
+	}
+	switch n := len(p.diagnosed); {
+	case n == 1:
+		return errors.New("found 1 problem")
+	case n > 1:
+		return fmt.Errorf("found %d problems", n)
+	}
+	return nil
+}
+
+// check runs gofmt, then go vet once the module is tidy, on the package in
+// path, sending the problems found as diagnostics. Only syntax errors,
+// which would stop the build anyway, are returned as an error.
+func (p *process) check(path string, hasModfile bool) error {
+	p.phase = phaseCheck
+	files, err := filepath.Glob(filepath.Join(path, "*.go"))
+	if err != nil {
+		return err
+	}
+	syntax := false
+	for _, f := range files {
+		src, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		for _, d := range gofmt(filepath.Base(f), src) {
+			syntax = syntax || d.Severity == "error"
+			p.diagnose(d)
+		}
+	}
+	if syntax {
+		return errSyntax
+	}
+
+	if hasModfile {
+		p.phase = phaseTidy
+		if err := p.goCmd(path, hasModfile, "mod", "tidy").Run(); err != nil {
+			return err
+		}
+		p.phase = phaseCheck
+	}
+	// Vet findings don't stop the build, as a snippet may well be showing
+	// one off.
+	cmd := p.goCmd(path, hasModfile, "vet", "-tags", "OMIT", ".")
+	cmd.Stdout = nil
+	cmd.Stderr = &diagnosticWriter{p: p, dir: path, source: "vet"}
+	cmd.Run()
+	return p.ctx.Err() // killed, rather than a finding
+}
+
+// goCmd returns a go command run in path.
+func (p *process) goCmd(path string, hasModfile bool, args ...string) *exec.Cmd {
+	cmd := p.buildCmd(path, append([]string{"go"}, args...)...)
+	cmd.Env = append(p.goBuild.environ(), p.target.env()...)
+	if !hasModfile {
+		cmd.Env = append(cmd.Env, "GO111MODULE=off")
+	}
+	return cmd
+}
+
+// gofmt returns the syntax errors in a Go file, or a warning if it isn't
+// formatted.
+func gofmt(name string, src []byte) []*Diagnostic {
+	out, err := format.Source(src)
+	if err != nil {
+		var list scanner.ErrorList
+		if !errors.As(err, &list) {
+			return []*Diagnostic{{File: name, Line: 1, Message: err.Error(), Source: "gofmt", Severity: "error"}}
+		}
+		var ds []*Diagnostic
+		for _, e := range list {
+			ds = append(ds, &Diagnostic{
+				File:     name,
+				Line:     e.Pos.Line,
+				Column:   e.Pos.Column,
+				Message:  e.Msg,
+				Source:   "gofmt",
+				Severity: "error",
+			})
+		}
+		return ds
+	}
+	if bytes.Equal(src, out) {
+		return nil
+	}
+	// Point at the first line that formatting changes.
+	a, b := bytes.Split(src, []byte("\n")), bytes.Split(out, []byte("\n"))
+	line := 1
+	for line <= len(a) && line <= len(b) && bytes.Equal(a[line-1], b[line-1]) {
+		line++
+	}
+	return []*Diagnostic{{File: name, Line: line, Message: "file is not gofmt-formatted", Source: "gofmt", Severity: "warning"}}
+}
+
+// diagnose sends a diagnostic, unless it has already been sent, eg: a type
+// error found by both go vet and the compiler.
+func (p *process) diagnose(d *Diagnostic) {
+	key := d.String()
+	if p.diagnosed[key] {
+		return
+	}
+	if p.diagnosed == nil {
+		p.diagnosed = make(map[string]bool)
+	}
+	p.diagnosed[key] = true
+	p.out <- &Message{Kind: "diagnostic", Diagnostic: d}
+}
+
+var diagnosticLine = regexp.MustCompile(`^(vet: )?(.+?\.go):(\d+)(?::(\d+))?: (.*)$`)
+
+// parseDiagnostic parses a line of go vet or compiler output for the
+// package in dir, returning nil if it isn't a diagnostic. Type errors are
+// reported with the compile source.
+func parseDiagnostic(line, dir, source string) *Diagnostic {
+	m := diagnosticLine.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	d := &Diagnostic{
+		File:     strings.TrimPrefix(m[2], "./"),
+		Message:  m[5],
+		Source:   source,
+		Severity: "error",
+	}
+	if rel, err := filepath.Rel(dir, m[2]); err == nil && filepath.IsAbs(m[2]) {
+		d.File = rel
+	}
+	d.Line, _ = strconv.Atoi(m[3])
+	d.Column, _ = strconv.Atoi(m[4])
+	if source == "vet" {
+		if m[1] != "" {
+			d.Source = "compile"
+		} else {
+			d.Severity = "warning"
+		}
+	}
+	return d
+}
+
+// diagnosticWriter sends diagnostics for each line of go vet or compiler
+// output. Compiler output is also passed on as "stderr" messages, as it was
+// before diagnostics, while only lines of go vet output that aren't
+// diagnostics are.
+type diagnosticWriter struct {
+	p      *process
+	dir    string // of the package
+	source string // "vet" or "compile"
+	line   []byte // the incomplete last line
+}
+
+func (w *diagnosticWriter) Write(b []byte) (int, error) {
+	if w.source == "compile" {
+		w.p.out <- &Message{Kind: "stderr", Body: safeString(b)}
+	}
+	w.line = append(w.line, b...)
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.line[:i])
+		if d := parseDiagnostic(line, w.dir, w.source); d != nil {
+			w.p.diagnose(d)
+		} else if w.source == "vet" && !strings.HasPrefix(line, "#") {
+			w.p.out <- &Message{Kind: "stderr", Body: safeString(w.line[:i+1])}
+		}
+		w.line = w.line[i+1:]
+	}
+	return len(b), nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+func TestGofmt(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []Diagnostic
+	}{
+		{"Formatted", "package main\n\nfunc main() {}\n", nil},
+		{"Unformatted", "package main\n\nfunc main()  {}\n", []Diagnostic{{File: "prog.go", Line: 3, Message: "file is not gofmt-formatted", Source: "gofmt", Severity: "warning"}}},
+		{"Syntax error", "package main\n\nfunc main() {\n\tx :=\n}\n", []Diagnostic{{File: "prog.go", Line: 5, Column: 1, Message: "expected operand, found '}'", Source: "gofmt", Severity: "error"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := gofmt("prog.go", []byte(tt.src))
+			if len(got) != len(tt.want) {
+				t.Fatalf("gofmt() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if *got[i] != tt.want[i] {
+					t.Errorf("gofmt()[%d] = %+v, want %+v", i, *got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseDiagnostic(t *testing.T) {
+	tests := []struct {
+		line   string
+		source string
+		want   *Diagnostic
+	}{
+		{"./prog.go:4:2: undefined: x", "compile", &Diagnostic{File: "prog.go", Line: 4, Column: 2, Message: "undefined: x", Source: "compile", Severity: "error"}},
+		{"vet: ./prog.go:4:2: undefined: x", "vet", &Diagnostic{File: "prog.go", Line: 4, Column: 2, Message: "undefined: x", Source: "compile", Severity: "error"}},
+		{"prog.go:6:14: fmt.Printf format %d has arg \"s\" of wrong type string", "vet", &Diagnostic{File: "prog.go", Line: 6, Column: 14, Message: "fmt.Printf format %d has arg \"s\" of wrong type string", Source: "vet", Severity: "warning"}},
+		{"/tmp/present-1/util.go:3: unreachable code", "vet", &Diagnostic{File: "util.go", Line: 3, Message: "unreachable code", Source: "vet", Severity: "warning"}},
+		{"# command-line-arguments", "compile", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got := parseDiagnostic(tt.line, "/tmp/present-1", tt.source)
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("parseDiagnostic() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	tests := []struct {
+		name    string
+		kind    string
+		body    string
+		want    []string
+		wantEnd string
+	}{
+		{
+			"Vet warning",
+			"check",
+			"package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Printf(\"%d\\n\", \"s\")\n}\n",
+			[]string{`vet prog.go:6:14: fmt.Printf format %d has arg "s" of wrong type string`},
+			"found 1 problem",
+		},
+		{
+			"Vet warnings",
+			"check",
+			"package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Printf(\"%d\\n\", \"s\")\n\tfmt.Printf(\"%s\\n\", 1)\n}\n",
+			[]string{
+				`vet prog.go:6:14: fmt.Printf format %d has arg "s" of wrong type string`,
+				`vet prog.go:7:14: fmt.Printf format %s has arg 1 of wrong type int`,
+			},
+			"found 2 problems",
+		},
+		{
+			"Clean",
+			"check",
+			"package main\n\nfunc main() {}\n",
+			nil,
+			"",
+		},
+		{
+			"Syntax error stops the build",
+			"run",
+			"package main\n\nfunc main() {\n\tx :=\n}\n",
+			[]string{"gofmt prog.go:5:1: expected operand, found '}'"},
+			errSyntax.Error(),
+		},
+		{
+			"Compile error",
+			"run",
+			"-- prog.go --\npackage main\n\nfunc main() {\n\tundefinedFn()\n}\n",
+			[]string{"compile prog.go:4:2: undefined: undefinedFn"},
+			"exit status 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := make(chan *Message)
+			if tt.kind == "check" {
+				startCheck("t", tt.body, dest, nil, nil, nil)
+			} else {
+				startProcess("t", tt.body, dest, nil, "", nil, nil)
+			}
+			var got []string
+			timeout := time.After(time.Minute)
+			for {
+				var m *Message
+				select {
+				case m = <-dest:
+				case <-timeout:
+					t.Fatal("check did not end")
+				}
+				if m.Kind == "diagnostic" {
+					got = append(got, m.Diagnostic.Source+" "+m.Diagnostic.String())
+				}
+				if m.Kind == "end" {
+					if m.Body != tt.wantEnd {
+						t.Errorf("end body = %q, want %q", m.Body, tt.wantEnd)
+					}
+					break
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got diagnostics %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("diagnostic %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
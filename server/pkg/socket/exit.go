@@ -0,0 +1,97 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	exec "golang.org/x/sys/execabs"
+	"golang.org/x/sys/unix"
+)
+
+// Exit describes how a process ended. It is sent with "end" messages, whose
+// Body still holds the error text for older clients.
+type Exit struct {
+	// Code is the exit code, or -1 if the process was killed by a signal
+	// or failed without exiting, eg: it could not be started.
+	Code int
+	// Signal is the signal which killed the process, eg: "SIGKILL".
+	Signal string `json:",omitempty"`
+	// Phase is what was running when the process ended: "format", "check",
+	// "tidy", "build", "init", "run" or "wait".
+	Phase string
+	// Duration is how long the process took, in seconds.
+	Duration float64
+	// KilledBy is "user", "limiter" or "timeout" if the process was killed.
+	KilledBy string `json:",omitempty"`
+	// Size is the size of the built Go binary, in bytes.
+	Size int64 `json:",omitempty"`
+	// Artifact is the URL path of the binary built for another platform,
+	// eg: a WebAssembly module, which is downloaded rather than run.
+	Artifact string `json:",omitempty"`
+}
+
+// Phases of a process.
+const (
+	phaseFormat = "format" // gofmt and import fixing
+	phaseCheck  = "check"  // gofmt and go vet
+	phaseTidy   = "tidy"   // go mod tidy
+	phaseBuild  = "build"  // go build
+	phaseInit   = "init"   // terraform init
+	phaseRun    = "run"
+	phaseWait   = "wait" // for applied Kubernetes objects to become ready
+)
+
+// Reasons a process was killed.
+const (
+	killedByUser    = "user"    // a "kill" message, or a new run with the same Id
+	killedByLimiter = "limiter" // too much output
+	killedByTimeout = "timeout" // the wall-clock or CPU time limit
+)
+
+// statusError is a non-zero exit status reported by a session, rather than
+// by waiting for a process.
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// killerFunc adapts a func to the killer interface.
+type killerFunc func()
+
+func (f killerFunc) Kill() { f() }
+
+// exitStatus returns the exit code and signal of a process given the error
+// it ended with.
+func exitStatus(err error) (code int, signal string) {
+	if err == nil {
+		return 0, ""
+	}
+	var se statusError
+	if errors.As(err, &se) {
+		return int(se), ""
+	}
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return -1, ""
+	}
+	if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return -1, unix.SignalName(ws.Signal())
+	}
+	return ee.ExitCode(), ""
+}
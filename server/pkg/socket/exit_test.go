@@ -0,0 +1,61 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"testing"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+func TestExit(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		opt      *Options
+		wantBody string
+		want     Exit
+	}{
+		{"Success", "#!/bin/sh\nexit 0", nil, "", Exit{Code: 0, Phase: "run"}},
+		{"Exit code", "#!/bin/sh\nexit 3", nil, "exit status 3", Exit{Code: 3, Phase: "run"}},
+		{"Signal", "#!/bin/sh\nkill -TERM $$", nil, "signal: terminated", Exit{Code: -1, Signal: "SIGTERM", Phase: "run"}},
+		{"Timeout", "#!/bin/sh\nsleep 5", &Options{Timeout: "100ms"}, "killed: timeout after 100ms", Exit{Code: -1, Signal: "SIGKILL", Phase: "run", KilledBy: "timeout"}},
+		{"Limiter", "#!/bin/sh\nwhile :; do echo; done", nil, "signal: killed", Exit{Code: -1, Signal: "SIGKILL", Phase: "run", KilledBy: "limiter"}},
+		{"Not started", "#!/does/not/exist", nil, "fork/exec /does/not/exist: no such file or directory", Exit{Code: -1, Phase: "run"}},
+		{"Build failure", "package main\n\nfunc main() { undefined() }\n", nil, "exit status 1", Exit{Code: 1, Phase: "build"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := exec.LookPath("go"); err != nil && tt.want.Phase == "build" {
+				t.Skip("go command not found")
+			}
+			m := runToEnd(t, tt.body, tt.opt, nil)
+			if m.Body != tt.wantBody {
+				t.Errorf("end body = %q, want %q", m.Body, tt.wantBody)
+			}
+			if m.Exit == nil {
+				t.Fatal("end message has no exit status")
+			}
+			got := *m.Exit
+			if got.Duration <= 0 {
+				t.Errorf("duration = %v, want > 0", got.Duration)
+			}
+			got.Duration = 0
+			if got != tt.want {
+				t.Errorf("exit = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
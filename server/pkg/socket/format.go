@@ -0,0 +1,105 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"go/format"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/rquitales/go-presentation-server/pkg/policy"
+	"golang.org/x/tools/imports"
+	"golang.org/x/tools/txtar"
+)
+
+// startFormat formats the Go files in a txtar archive, sending the
+// rewritten archive in a "formatted" message, or the syntax errors found as
+// diagnostics, followed by the end event on the provided channel.
+func startFormat(id, body string, dest chan<- *Message, opt *Options, pol *policy.Policy) *process {
+	p := newProcess(id, "", dest, opt, pol)
+	err := p.startFormat(body, opt)
+	go p.end(err)
+	return p
+}
+
+// startFormat runs gofmt over each Go file in the archive, and fixes their
+// imports too if opt.Imports is set. The archive is only sent back if every
+// file could be formatted.
+func (p *process) startFormat(body string, opt *Options) error {
+	p.phase = phaseFormat
+	a := txtar.Parse([]byte(body))
+	// As with runs, the archive's comment is prog.go.
+	comment := len(a.Comment) != 0
+	if comment {
+		a.Files = append(a.Files, txtar.File{Name: "prog.go", Data: a.Comment})
+		a.Comment = nil
+	}
+
+	fixImports := opt != nil && opt.Imports
+	if fixImports {
+		// Write the archive out, so that imports are resolved against its
+		// go.mod and other files.
+		path, err := ioutil.TempDir("", "present-format-")
+		if err != nil {
+			return err
+		}
+		p.path = path // to be removed by p.end
+		if _, err := writeArchive(path, string(txtar.Format(a)), "prog.go"); err != nil {
+			return err
+		}
+	}
+
+	syntax := false
+	for i, f := range a.Files {
+		if !strings.HasSuffix(f.Name, ".go") {
+			continue
+		}
+		if ds := gofmt(f.Name, f.Data); len(ds) > 0 && ds[0].Severity == "error" {
+			for _, d := range ds {
+				p.diagnose(d)
+			}
+			syntax = true
+			continue
+		}
+		var (
+			out []byte
+			err error
+		)
+		if fixImports {
+			out, err = imports.Process(filepath.Join(p.path, f.Name), f.Data, &imports.Options{
+				Comments:  true,
+				TabIndent: true,
+				TabWidth:  8,
+			})
+		} else {
+			out, err = format.Source(f.Data)
+		}
+		if err != nil {
+			return err
+		}
+		a.Files[i].Data = out
+	}
+	if syntax {
+		return errSyntax
+	}
+
+	if comment {
+		last := len(a.Files) - 1
+		a.Comment, a.Files = a.Files[last].Data, a.Files[:last]
+	}
+	p.out <- &Message{Kind: "formatted", Body: string(txtar.Format(a))}
+	return nil
+}
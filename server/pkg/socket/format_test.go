@@ -0,0 +1,93 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		opt     *Options
+		want    string
+		wantEnd string
+	}{
+		{
+			"Single file",
+			"package main\nfunc main()  { }\n",
+			nil,
+			"package main\n\nfunc main() {}\n",
+			"",
+		},
+		{
+			"Archive",
+			"-- go.mod --\nmodule m\n-- prog.go --\npackage main\nfunc main()  { }\n-- notes.txt --\nleft   alone\n",
+			nil,
+			"-- go.mod --\nmodule m\n-- prog.go --\npackage main\n\nfunc main() {}\n-- notes.txt --\nleft   alone\n",
+			"",
+		},
+		{
+			"Imports left alone",
+			"package main\n\nimport \"os\"\n\nfunc main() { fmt.Println() }\n",
+			nil,
+			"package main\n\nimport \"os\"\n\nfunc main() { fmt.Println() }\n",
+			"",
+		},
+		{
+			"Imports fixed",
+			"package main\n\nimport \"os\"\n\nfunc main() { fmt.Println() }\n",
+			&Options{Imports: true},
+			"package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println() }\n",
+			"",
+		},
+		{
+			"Syntax error",
+			"package main\n\nfunc main() {\n\tx :=\n}\n",
+			nil,
+			"",
+			errSyntax.Error(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := make(chan *Message, 10)
+			startFormat("t", tt.body, dest, tt.opt, nil)
+			var got string
+			var diagnostics int
+			for end := false; !end; {
+				m := <-dest
+				switch m.Kind {
+				case "formatted":
+					got = m.Body
+				case "diagnostic":
+					diagnostics++
+				case "end":
+					end = true
+					if m.Body != tt.wantEnd || m.Exit.Phase != "format" {
+						t.Errorf("got end %q in phase %q, want %q in phase format", m.Body, m.Exit.Phase, tt.wantEnd)
+					}
+				}
+			}
+			if got != tt.want {
+				t.Errorf("got formatted body %q, want %q", got, tt.want)
+			}
+			if wantErr := tt.wantEnd != ""; wantErr != (diagnostics > 0) {
+				t.Errorf("got %d diagnostics, want some: %v", diagnostics, wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+// GoBuild configures how Go snippets are built.
+type GoBuild struct {
+	// CacheDir holds the build and module caches shared by every run, and
+	// the binaries built from each snippet so that re-running one skips
+	// the build. Only the maxCachedBinaries built last are kept. Empty
+	// uses the go command's defaults and caches nothing.
+	CacheDir string
+	// Offline stops the go command from downloading modules, so snippets
+	// may only use modules already in the module cache.
+	Offline bool
+	// Modules is a directory of modules laid out like a module proxy, eg: a
+	// copy of $GOMODCACHE/cache/download, used instead of the network.
+	// It implies Offline.
+	Modules string
+	// Artifacts stores the binaries built for other platforms, such as
+	// WebAssembly modules, for download. Without it, snippets can only be
+	// built for the server's platform.
+	Artifacts *Artifacts
+}
+
+// target is the platform a Go snippet is built for. The zero target is the
+// server's platform.
+type target struct {
+	goos, goarch string
+}
+
+// newTarget returns the target requested by opt.
+func newTarget(opt *Options) target {
+	t := target{goos: runtime.GOOS, goarch: runtime.GOARCH}
+	if opt != nil && opt.GOOS != "" {
+		t.goos = opt.GOOS
+	}
+	if opt != nil && opt.GOARCH != "" {
+		t.goarch = opt.GOARCH
+	}
+	if t.host() {
+		return target{}
+	}
+	return t
+}
+
+// host reports whether binaries built for t run on the server.
+func (t target) host() bool {
+	return t == (target{}) || t == (target{goos: runtime.GOOS, goarch: runtime.GOARCH})
+}
+
+// String returns t as GOOS/GOARCH, eg: "js/wasm".
+func (t target) String() string {
+	if t == (target{}) {
+		return runtime.GOOS + "/" + runtime.GOARCH
+	}
+	return t.goos + "/" + t.goarch
+}
+
+// env returns the go command's environment for building for t.
+func (t target) env() []string {
+	if t == (target{}) {
+		return nil
+	}
+	return []string{"GOOS=" + t.goos, "GOARCH=" + t.goarch}
+}
+
+// exe returns the name of a binary built for t.
+func (t target) exe(name string) string {
+	switch {
+	case t.goarch == "wasm":
+		return name + ".wasm"
+	case t.goos == "windows", t == (target{}) && runtime.GOOS == "windows":
+		return name + ".exe"
+	}
+	return name
+}
+
+// maxCachedBinaries bounds how many binaries built from snippets are cached,
+// which is plenty for the snippets of a presentation or two.
+const maxCachedBinaries = 100
+
+// goBuilder builds Go snippets with the caches and network access
+// configured by a GoBuild.
+type goBuilder struct {
+	env   []string   // added to the environment of the go command
+	bin   string     // directory of cached binaries, if any
+	store *Artifacts // binaries built for other platforms, if enabled
+
+	once      sync.Once
+	version   string // of the go command, part of the cache key
+	test2json string // path of the go command's test2json tool
+}
+
+// defaultGoBuilder is used to find the go command's tools when there is no
+// goBuilder.
+var defaultGoBuilder goBuilder
+
+// newGoBuilder creates the cache directories for cfg.
+func newGoBuilder(cfg GoBuild) (*goBuilder, error) {
+	b := &goBuilder{store: cfg.Artifacts}
+	if cfg.CacheDir != "" {
+		dir, err := filepath.Abs(cfg.CacheDir)
+		if err != nil {
+			return nil, err
+		}
+		b.bin = filepath.Join(dir, "bin")
+		for _, d := range []string{"gocache", "gomodcache", "bin"} {
+			if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+				return nil, fmt.Errorf("unable to create go cache: %w", err)
+			}
+		}
+		b.env = append(b.env,
+			"GOCACHE="+filepath.Join(dir, "gocache"),
+			"GOMODCACHE="+filepath.Join(dir, "gomodcache"),
+		)
+	}
+	switch {
+	case cfg.Modules != "":
+		dir, err := filepath.Abs(cfg.Modules)
+		if err != nil {
+			return nil, err
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("go modules must be a directory: %q", cfg.Modules)
+		}
+		// The checksum database is online, so rely on the go.sum files of
+		// the snippets instead.
+		b.env = append(b.env, "GOPROXY=file://"+filepath.ToSlash(dir), "GOSUMDB=off")
+	case cfg.Offline:
+		b.env = append(b.env, "GOPROXY=off", "GOSUMDB=off")
+	}
+	return b, nil
+}
+
+// environ returns the environment for the go command.
+func (b *goBuilder) environ() []string {
+	if b == nil {
+		return Environ()
+	}
+	return append(Environ(), b.env...)
+}
+
+// artifacts returns the store for binaries built for other platforms, or
+// nil if building them isn't enabled.
+func (b *goBuilder) artifacts() *Artifacts {
+	if b == nil {
+		return nil
+	}
+	return b.store
+}
+
+// cached returns where the binary built from body for t with the go
+// command's args is cached, and whether it has already been built. It
+// returns "" if binaries aren't cached.
+func (b *goBuilder) cached(body string, t target, args []string) (bin string, ok bool) {
+	if b == nil || b.bin == "" {
+		return "", false
+	}
+	version, _ := b.goEnv()
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s %q\n", version, t, args)
+	h.Write([]byte(body))
+	bin = filepath.Join(b.bin, t.exe(hex.EncodeToString(h.Sum(nil))))
+	_, err := os.Stat(bin)
+	return bin, err == nil
+}
+
+// prune removes the oldest cached binaries, keeping maxCachedBinaries.
+func (b *goBuilder) prune() {
+	if b == nil || b.bin == "" {
+		return
+	}
+	fis, err := ioutil.ReadDir(b.bin)
+	if err != nil {
+		return
+	}
+	var bins []os.FileInfo
+	for _, fi := range fis {
+		if !strings.Contains(fi.Name(), "-") { // otherwise still being built
+			bins = append(bins, fi)
+		}
+	}
+	if len(bins) <= maxCachedBinaries {
+		return
+	}
+	sort.Slice(bins, func(i, j int) bool { return bins[i].ModTime().Before(bins[j].ModTime()) })
+	for _, fi := range bins[:len(bins)-maxCachedBinaries] {
+		os.Remove(filepath.Join(b.bin, fi.Name()))
+	}
+}
+
+// goEnv returns the version of the go command and the path of its
+// test2json tool, which may have to be built first.
+func (b *goBuilder) goEnv() (version, test2json string) {
+	if b == nil {
+		b = &defaultGoBuilder
+	}
+	b.once.Do(func() {
+		output := func(args ...string) string {
+			cmd := exec.Command("go", args...)
+			cmd.Env = b.environ()
+			out, err := cmd.Output()
+			if err != nil {
+				return ""
+			}
+			return strings.TrimSpace(string(out))
+		}
+		b.version = output("env", "GOVERSION")
+		b.test2json = output("tool", "-n", "test2json")
+	})
+	return b.version, b.test2json
+}
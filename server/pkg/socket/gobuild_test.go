@@ -0,0 +1,143 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+func TestNewGoBuilder(t *testing.T) {
+	cache, modules := t.TempDir(), t.TempDir()
+	tests := []struct {
+		name    string
+		cfg     GoBuild
+		want    []string
+		wantErr bool
+	}{
+		{"Defaults", GoBuild{}, nil, false},
+		{"Cache", GoBuild{CacheDir: cache}, []string{"GOCACHE=" + filepath.Join(cache, "gocache"), "GOMODCACHE=" + filepath.Join(cache, "gomodcache")}, false},
+		{"Offline", GoBuild{Offline: true}, []string{"GOPROXY=off", "GOSUMDB=off"}, false},
+		{"Modules", GoBuild{Modules: modules, Offline: true}, []string{"GOPROXY=file://" + modules, "GOSUMDB=off"}, false},
+		{"Missing modules", GoBuild{Modules: filepath.Join(modules, "missing")}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := newGoBuilder(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newGoBuilder() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if strings.Join(b.env, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("env = %q, want %q", b.env, tt.want)
+			}
+		})
+	}
+}
+
+func TestGoBuildCache(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	// Use the default build cache, so that only the binaries are cached
+	// in the test directory.
+	b := &goBuilder{bin: t.TempDir()}
+	const prog = "package main\n\nfunc main() { println(\"hello\") }\n"
+
+	run := func() (stderr string, end *Message) {
+		dest := make(chan *Message)
+		startProcess("t", prog, dest, nil, "", nil, b)
+		timeout := time.After(time.Minute)
+		for {
+			select {
+			case m := <-dest:
+				if m.Kind == "stderr" {
+					stderr += m.Body
+				}
+				if m.Kind == "end" {
+					return stderr, m
+				}
+			case <-timeout:
+				t.Fatal("process did not end")
+			}
+		}
+	}
+
+	if out, end := run(); out != "hello\n" || end.Body != "" {
+		t.Fatalf("first run: got stderr %q, end %q", out, end.Body)
+	}
+	bins, _ := ioutil.ReadDir(b.bin)
+	if len(bins) != 1 {
+		t.Fatalf("got %d cached binaries, want 1", len(bins))
+	}
+	if _, ok := b.cached(prog, target{}, []string{"build"}); !ok {
+		t.Error("binary is not cached")
+	}
+	if _, ok := b.cached(prog, target{}, []string{"build", "-race"}); ok {
+		t.Error("race binary is cached")
+	}
+
+	// The second run uses the cached binary.
+	if out, end := run(); out != "hello\n" || end.Body != "" {
+		t.Fatalf("second run: got stderr %q, end %q", out, end.Body)
+	}
+	if again, _ := ioutil.ReadDir(b.bin); len(again) != 1 || !again[0].ModTime().Equal(bins[0].ModTime()) {
+		t.Error("binary was rebuilt")
+	}
+}
+
+func TestGoBuildCachePrune(t *testing.T) {
+	b := &goBuilder{bin: t.TempDir()}
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < maxCachedBinaries+2; i++ {
+		bin := filepath.Join(b.bin, fmt.Sprintf("%03d", i))
+		if err := ioutil.WriteFile(bin, nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+		mtime := start.Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(bin, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A binary still being built is left alone, however old.
+	building := filepath.Join(b.bin, "000-present-1")
+	if err := ioutil.WriteFile(building, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(building, start, start); err != nil {
+		t.Fatal(err)
+	}
+
+	b.prune()
+	for _, name := range []string{"000", "001"} {
+		if _, err := os.Stat(filepath.Join(b.bin, name)); !os.IsNotExist(err) {
+			t.Errorf("binary %s was kept, want it pruned", name)
+		}
+	}
+	for _, name := range []string{"002", fmt.Sprintf("%03d", maxCachedBinaries+1), "000-present-1"} {
+		if _, err := os.Stat(filepath.Join(b.bin, name)); err != nil {
+			t.Errorf("binary %s was pruned: %v", name, err)
+		}
+	}
+}
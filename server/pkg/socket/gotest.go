@@ -0,0 +1,203 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rquitales/go-presentation-server/pkg/policy"
+)
+
+// TestResult is the result of a test, sent in "testResult" messages.
+type TestResult struct {
+	Name    string  // eg: "TestParse/empty"
+	Result  string  // "pass", "fail" or "skip"
+	Elapsed float64 // in seconds
+}
+
+// BenchmarkResult is the result of a benchmark, sent in "benchmark"
+// messages.
+type BenchmarkResult struct {
+	Name        string // eg: "BenchmarkParse-8"
+	N           int    // number of iterations
+	NsPerOp     float64
+	BytesPerOp  int64   `json:",omitempty"`
+	AllocsPerOp int64   `json:",omitempty"`
+	MBPerSec    float64 `json:",omitempty"`
+}
+
+// startTest builds the tests in a txtar archive and runs them, sending
+// their output, results and end event as Messages on the provided channel.
+func startTest(id, body string, dest chan<- *Message, opt *Options, pol *policy.Policy, gb *goBuilder) *process {
+	p := newProcess(id, golang, dest, opt, pol)
+	p.goBuild = gb
+	p.background(opt, func() error { return p.startTest(body, opt) })
+	return p
+}
+
+// startTest builds a test binary with "go test -c" and runs it in the
+// package directory, so that tests can read their testdata.
+func (p *process) startTest(body string, opt *Options) error {
+	path, err := ioutil.TempDir("", "present-test-")
+	if err != nil {
+		return err
+	}
+	p.path = path // to be removed by p.end
+
+	hasModfile, err := writeArchive(path, body, "prog_test.go")
+	if err != nil {
+		return err
+	}
+	args := []string{"test", "-c"}
+	if opt != nil && opt.Race {
+		args = append(args, "-race")
+	}
+	bin, cached := p.goBuild.cached(body, p.target, args)
+	if !cached {
+		if bin, err = p.build(path, bin, hasModfile, args...); err != nil {
+			return err
+		}
+	}
+	p.phase = phaseRun
+
+	// Run the test binary under test2json, as "go test -json" does.
+	_, test2json := p.goBuild.goEnv()
+	if test2json == "" {
+		return errors.New("unable to find the go command's test2json tool")
+	}
+	targs := []string{test2json, bin, "-test.v"}
+	if opt != nil && opt.Run != "" {
+		targs = append(targs, "-test.run", opt.Run)
+	}
+	if opt != nil && opt.Bench != "" {
+		targs = append(targs, "-test.bench", opt.Bench, "-test.benchmem")
+	}
+	cmd := p.cmd(path, targs...)
+	cmd.Stdout = &testWriter{out: p.out}
+	// Assign a process group ID that test2json and the tests will belong to.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := p.sandbox(cmd, golang, path, filepath.Dir(bin)); err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.run = cmd
+	return nil
+}
+
+var benchLine = regexp.MustCompile(`^(Benchmark\S*)\s+(\d+)\s+([0-9.]+) ns/op`)
+var benchUnit = regexp.MustCompile(`([0-9.]+) (B/op|allocs/op|MB/s)`)
+
+// testEvent is an event printed by test2json.
+type testEvent struct {
+	Action  string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// testWriter passes on the output of test2json as "stdout" messages, along
+// with "testResult" and "benchmark" messages for the results.
+type testWriter struct {
+	out    chan<- *Message
+	line   []byte // the incomplete last line written
+	output string // the incomplete last line of test output
+}
+
+func (w *testWriter) Write(b []byte) (int, error) {
+	w.line = append(w.line, b...)
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			break
+		}
+		var e testEvent
+		if err := json.Unmarshal(w.line[:i], &e); err != nil {
+			// Not an event, eg: the test binary could not be run.
+			w.out <- &Message{Kind: "stdout", Body: safeString(w.line[:i+1])}
+		} else {
+			for _, m := range w.messages(e) {
+				w.out <- m
+			}
+		}
+		w.line = w.line[i+1:]
+	}
+	return len(b), nil
+}
+
+// messages returns the messages for a test2json event. Benchmark results
+// may be split across several output events, so are parsed once their line
+// is complete.
+func (w *testWriter) messages(e testEvent) []*Message {
+	var ms []*Message
+	if e.Output != "" {
+		ms = append(ms, &Message{Kind: "stdout", Body: e.Output})
+		w.output += e.Output
+		for {
+			i := strings.IndexByte(w.output, '\n')
+			if i < 0 {
+				break
+			}
+			if r := parseBenchmark(w.output[:i]); r != nil {
+				ms = append(ms, &Message{Kind: "benchmark", Benchmark: r})
+			}
+			w.output = w.output[i+1:]
+		}
+	}
+	switch e.Action {
+	case "pass", "fail", "skip":
+		if e.Test != "" {
+			ms = append(ms, &Message{Kind: "testResult", Test: &TestResult{
+				Name:    e.Test,
+				Result:  e.Action,
+				Elapsed: e.Elapsed,
+			}})
+		}
+	}
+	return ms
+}
+
+// parseBenchmark parses a benchmark result line, or returns nil if line
+// isn't one.
+func parseBenchmark(line string) *BenchmarkResult {
+	m := benchLine.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	r := &BenchmarkResult{Name: m[1]}
+	r.N, _ = strconv.Atoi(m[2])
+	r.NsPerOp, _ = strconv.ParseFloat(m[3], 64)
+	for _, u := range benchUnit.FindAllStringSubmatch(line, -1) {
+		v, _ := strconv.ParseFloat(u[1], 64)
+		switch u[2] {
+		case "B/op":
+			r.BytesPerOp = int64(v)
+		case "allocs/op":
+			r.AllocsPerOp = int64(v)
+		case "MB/s":
+			r.MBPerSec = v
+		}
+	}
+	return r
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+const testArchive = `-- go.mod --
+module example.com/greet
+
+go 1.16
+-- greet.go --
+package greet
+
+func Greet(name string) string { return "hello " + name }
+-- greet_test.go --
+package greet
+
+import "testing"
+
+func TestGreet(t *testing.T) {
+	if got := Greet("gopher"); got != "hello gopher" {
+		t.Errorf("Greet() = %q", got)
+	}
+}
+
+func TestFail(t *testing.T) {
+	t.Run("sub", func(t *testing.T) { t.Fatal("broken") })
+}
+
+func TestSkip(t *testing.T) { t.Skip("later") }
+
+func BenchmarkGreet(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Greet("gopher")
+	}
+}
+`
+
+func TestGoTest(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	tests := []struct {
+		name      string
+		body      string
+		opt       *Options
+		want      map[string]string
+		wantBench bool
+		wantEnd   string
+		wantPhase string
+	}{
+		{
+			"All tests",
+			testArchive,
+			nil,
+			map[string]string{"TestGreet": "pass", "TestFail": "fail", "TestFail/sub": "fail", "TestSkip": "skip"},
+			false,
+			"exit status 1",
+			"run",
+		},
+		{
+			"Run and bench",
+			testArchive,
+			&Options{Run: "Greet", Bench: "."},
+			map[string]string{"TestGreet": "pass"},
+			true,
+			"",
+			"run",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := make(chan *Message)
+			startTest("t", tt.body, dest, tt.opt, nil, nil)
+			got := map[string]string{}
+			var bench *BenchmarkResult
+			timeout := time.After(time.Minute)
+			for {
+				var m *Message
+				select {
+				case m = <-dest:
+				case <-timeout:
+					t.Fatal("tests did not end")
+				}
+				if m.Kind == "testResult" {
+					got[m.Test.Name] = m.Test.Result
+				}
+				if m.Kind == "benchmark" {
+					bench = m.Benchmark
+				}
+				if m.Kind != "end" {
+					continue
+				}
+				if m.Body != tt.wantEnd || m.Exit.Phase != tt.wantPhase {
+					t.Errorf("end body %q in phase %q, want %q in %q", m.Body, m.Exit.Phase, tt.wantEnd, tt.wantPhase)
+				}
+				break
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("got results %v, want %v", got, tt.want)
+			}
+			for name, result := range tt.want {
+				if got[name] != result {
+					t.Errorf("%s: got %q, want %q", name, got[name], result)
+				}
+			}
+			if tt.wantBench && (bench == nil || bench.N == 0 || bench.NsPerOp == 0) {
+				t.Errorf("got benchmark %+v", bench)
+			}
+		})
+	}
+}
+
+func TestParseBenchmark(t *testing.T) {
+	got := parseBenchmark("BenchmarkGreet-8   \t 1000000\t      52.3 ns/op\t  12.5 MB/s\t      16 B/op\t       1 allocs/op\n")
+	want := BenchmarkResult{Name: "BenchmarkGreet-8", N: 1000000, NsPerOp: 52.3, BytesPerOp: 16, AllocsPerOp: 1, MBPerSec: 12.5}
+	if got == nil || *got != want {
+		t.Errorf("parseBenchmark() = %+v, want %+v", got, want)
+	}
+	if got := parseBenchmark("=== RUN   BenchmarkGreet\n"); got != nil {
+		t.Errorf("parseBenchmark() = %+v, want nil", got)
+	}
+}
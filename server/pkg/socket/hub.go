@@ -0,0 +1,73 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"log"
+	"sync"
+)
+
+// The number of messages buffered per audience connection before output
+// is dropped for that connection.
+const audienceBuffer = 256
+
+// hub broadcasts the output of presenter processes to the audience
+// connections that joined the same named presentation session. Connections
+// which don't name a session join the unnamed one.
+type hub struct {
+	mu       sync.Mutex
+	sessions map[string]map[chan<- *Message]bool // subscribers by session
+}
+
+func newHub() *hub {
+	return &hub{sessions: make(map[string]map[chan<- *Message]bool)}
+}
+
+// subscribe registers out to receive every Message published to session.
+func (h *hub) subscribe(session string, out chan<- *Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs := h.sessions[session]
+	if subs == nil {
+		subs = make(map[chan<- *Message]bool)
+		h.sessions[session] = subs
+	}
+	subs[out] = true
+}
+
+// unsubscribe removes out from session. Once it returns, no more Messages
+// are sent on out and it is safe to close.
+func (h *hub) unsubscribe(session string, out chan<- *Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.sessions[session], out)
+	if len(h.sessions[session]) == 0 {
+		delete(h.sessions, session)
+	}
+}
+
+// publish sends m to every subscriber of session without blocking. A slow
+// audience connection misses messages rather than stalling the presenter.
+func (h *hub) publish(session string, m *Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for out := range h.sessions[session] {
+		select {
+		case out <- m:
+		default:
+			log.Println("audience connection too slow, dropping message for:", m.Id)
+		}
+	}
+}
@@ -15,64 +15,128 @@
 package socket
 
 import (
-	"io/ioutil"
-	"path/filepath"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/rquitales/go-presentation-server/pkg/k8s"
+	"github.com/rquitales/go-presentation-server/pkg/policy"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
-// startKubectl saves a yaml file and runs the specified kubectl action on the yaml file,
-// sending its output and end event as Messages on the provided channel.
-func startKubectl(id, action, body string, dest chan<- *Message, opt *Options) *process {
-	var (
-		done = make(chan struct{})
-		out  = make(chan *Message)
-		p    = &process{out: out, done: done}
-	)
-	go func() {
-		defer close(done)
-		for m := range buffer(limiter(out, p), time.After) {
-			m.Id = id
-			dest <- m
-		}
-	}()
+var errNoCluster = errors.New("no Kubernetes cluster is configured")
 
-	err := p.startKubectl(action, body, opt)
+// startKubectl applies, creates or deletes the objects of a manifest, or
+// reports what applying them would do, as given by action, sending a
+// "kubectlResult" message for each object and the end event as Messages
+// on the provided channel. With the Wait option, applied objects are then
+// watched until they are ready, sending "kubectlStatus" messages as they
+// change.
+func startKubectl(id, action, body string, dest chan<- *Message, opt *Options, pol *policy.Policy, kc *k8s.Client) *process {
+	p := newProcess(id, kubectl, dest, opt, pol)
+
+	var wait time.Duration
+	if opt != nil && action == "apply" {
+		wait, _ = time.ParseDuration(opt.Wait) // already validated
+	}
+	err := p.startKubectl(action, body, kc, wait)
 	if err != nil {
 		p.end(err)
 		return nil
 	}
-	go func() {
-		p.end(p.run.Wait())
-	}()
+	p.wait(opt)
 	return p
 }
 
-// startKubectl saves a yaml and kubectl apply/create/deletes it, sending its output to p.out,
-// and stores the running *exec.Cmd in the run field.
-func (p *process) startKubectl(action string, body string, opt *Options) error {
-	// We save the body to a yaml then kubectl apply it.
-
-	path, err := ioutil.TempDir("", "present-kubectl-")
+// startKubectl decodes the manifest and starts making the changes to the
+// cluster, sending the result of each to p.out, then waiting for them to
+// be ready if wait is set.
+func (p *process) startKubectl(action string, body string, kc *k8s.Client, wait time.Duration) error {
+	if kc == nil {
+		return errNoCluster
+	}
+	objs, err := k8s.Decode(body)
 	if err != nil {
 		return err
 	}
-	p.path = path // to be removed by p.end
-
-	out := "k8s.yml"
+	p.result = make(chan error, 1)
+	go func() {
+		err := p.kubectl(p.ctx, kc, action, objs)
+		if err == nil && wait > 0 {
+			err = p.waitReady(p.ctx, kc, objs, wait)
+		}
+		p.result <- err
+	}()
+	return nil
+}
 
-	err = ioutil.WriteFile(filepath.Join(path, out), []byte(body), 0666)
-	if err != nil {
-		return err
+// kubectl makes the changes, carrying on after an object fails like
+// kubectl does.
+func (p *process) kubectl(ctx context.Context, kc *k8s.Client, action string, objs []*unstructured.Unstructured) error {
+	failed := 0
+	for _, obj := range objs {
+		r, err := kc.Do(ctx, action, obj)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			failed++
+			p.out <- &Message{Kind: "stderr", Body: fmt.Sprintf("%s: %v\n", k8s.Describe(obj), err)}
+			continue
+		}
+		p.out <- &Message{Kind: "kubectlResult", Body: r.String() + "\n" + r.Diff, Object: r}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d objects failed", failed, len(objs))
 	}
+	return nil
+}
 
-	args := []string{"kubectl", action, "-f", out}
-	cmd := p.cmd(path, args...)
-	// cmd.Stdout = cmd.Stderr // send compiler output to stderr
+// waitReady waits up to timeout for the objects to become ready, sending
+// their status as it changes, then a summary.
+func (p *process) waitReady(ctx context.Context, kc *k8s.Client, objs []*unstructured.Unstructured, timeout time.Duration) error {
+	p.phase = phaseWait
+	start := time.Now()
+	wctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	errs := make([]error, len(objs))
+	var wg sync.WaitGroup
+	for i, obj := range objs {
+		wg.Add(1)
+		go func(i int, obj *unstructured.Unstructured) {
+			defer wg.Done()
+			errs[i] = kc.Wait(wctx, obj, func(s *k8s.Status) {
+				p.out <- &Message{Kind: "kubectlStatus", Body: s.String() + "\n", Status: s}
+			})
+		}(i, obj)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err() // killed
+	}
 
-	if err := cmd.Start(); err != nil {
-		return err
+	var pending []string
+	failed := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+		case wctx.Err() != nil:
+			pending = append(pending, k8s.Describe(objs[i]))
+		default:
+			failed++
+			p.out <- &Message{Kind: "stderr", Body: fmt.Sprintf("%s: %v\n", k8s.Describe(objs[i]), err)}
+		}
+	}
+	ready := len(objs) - len(pending) - failed
+	p.out <- &Message{Kind: "stdout", Body: fmt.Sprintf("%d of %d objects ready after %v\n", ready, len(objs), time.Since(start).Round(time.Millisecond))}
+	switch {
+	case len(pending) > 0:
+		return fmt.Errorf("timed out after %v waiting for %s", timeout, strings.Join(pending, ", "))
+	case failed > 0:
+		return fmt.Errorf("%d of %d objects failed to become ready", failed, len(objs))
 	}
-	p.run = cmd
-	p.kind = kubectl
 	return nil
 }
@@ -0,0 +1,99 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rquitales/go-presentation-server/pkg/k8s"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestKubectl(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	dyn := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	// The fake client doesn't support server-side apply, which creates the
+	// objects here.
+	dyn.PrependReactor("patch", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		pa := action.(clienttesting.PatchAction)
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(pa.GetPatch()); err != nil {
+			return true, nil, err
+		}
+		return true, obj, dyn.Tracker().Create(pa.GetResource(), obj, pa.GetNamespace())
+	})
+	kc := k8s.NewClient(dyn, nil, mapper, "default")
+
+	const manifest = "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\n"
+	tests := []struct {
+		name       string
+		action     string
+		opt        *Options
+		client     *k8s.Client
+		want       []string // actions taken, and statuses
+		wantStderr bool
+		wantEnd    string
+	}{
+		{"Create", "create", nil, kc, []string{k8s.Created, k8s.Created}, false, ""},
+		{"Create existing", "create", nil, kc, nil, true, "2 of 2 objects failed"},
+		{"Delete", "delete", nil, kc, []string{k8s.Deleted, k8s.Deleted}, false, ""},
+		{"Apply and wait", "apply", &Options{Wait: "1m"}, kc, []string{k8s.Created, k8s.Created, "ready", "ready", "2 of 2 objects ready"}, false, ""},
+		{"No cluster", "apply", nil, nil, nil, false, errNoCluster.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := make(chan *Message, 10)
+			startKubectl("k", tt.action, manifest, dest, tt.opt, nil, tt.client)
+			var got []string
+			var stderr bool
+			for end := false; !end; {
+				m := <-dest
+				switch m.Kind {
+				case "kubectlResult":
+					if m.Object.Namespace != "default" {
+						t.Errorf("got %s in namespace %q, want default", m.Body, m.Object.Namespace)
+					}
+					got = append(got, m.Object.Action)
+				case "kubectlStatus":
+					got = append(got, m.Status.Message)
+				case "stdout":
+					got = append(got, strings.SplitN(m.Body, " after", 2)[0]) // the summary
+				case "stderr":
+					stderr = true
+				case "end":
+					end = true
+					if m.Body != tt.wantEnd {
+						t.Errorf("got end %q, want %q", m.Body, tt.wantEnd)
+					}
+				}
+			}
+			if len(got) != len(tt.want) || stderr != tt.wantStderr {
+				t.Fatalf("got actions %q and stderr %v, want %q and %v", got, stderr, tt.want, tt.wantStderr)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got action %q, want %q", got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"github.com/rquitales/go-presentation-server/pkg/k8s"
+	"github.com/rquitales/go-presentation-server/pkg/policy"
+)
+
+// startLogs follows the logs of the containers of the pods selected by the
+// options, sending a "log" message for each line, prefixed with its pod and
+// container, until the process is killed. Like any process, it is killed
+// once it sends more than msgLimit messages.
+func startLogs(id string, dest chan<- *Message, opt *Options, pol *policy.Policy, kc *k8s.Client) *process {
+	p := newProcess(id, stream, dest, opt, pol)
+
+	err := p.startLogs(opt, kc)
+	if err != nil {
+		p.end(err)
+		return nil
+	}
+	p.wait(opt)
+	return p
+}
+
+// startLogs starts following the logs, sending their lines to p.out.
+func (p *process) startLogs(opt *Options, kc *k8s.Client) error {
+	if kc == nil {
+		return errNoCluster
+	}
+	if opt == nil {
+		opt = &Options{}
+	}
+	p.result = make(chan error, 1)
+	go func() {
+		p.result <- stopped(kc.Logs(p.ctx, opt.Namespace, opt.Selector, func(l *k8s.LogLine) {
+			if l.Err != "" {
+				p.out <- &Message{Kind: "stderr", Body: l.String() + "\n"}
+				return
+			}
+			p.out <- &Message{Kind: "log", Body: l.String() + "\n", Log: l}
+		}))
+	}()
+	return nil
+}
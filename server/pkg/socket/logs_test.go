@@ -0,0 +1,76 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"testing"
+
+	"github.com/rquitales/go-presentation-server/pkg/k8s"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLogs(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, meta.RESTScopeNamespace)
+	pod := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": "web-1", "namespace": "default", "labels": map[string]interface{}{"app": "web"}},
+		"status": map[string]interface{}{"containerStatuses": []interface{}{
+			map[string]interface{}{"name": "nginx", "state": map[string]interface{}{"running": map[string]interface{}{}}},
+		}},
+	}}
+	kc := k8s.NewClient(fake.NewSimpleDynamicClient(runtime.NewScheme(), pod), kubefake.NewSimpleClientset(), mapper, "default")
+
+	tests := []struct {
+		name     string
+		opt      *Options
+		client   *k8s.Client
+		wantLogs int // before the process is killed
+		wantEnd  string
+		wantBy   string
+	}{
+		{"Killed", &Options{Selector: "app=web"}, kc, 1, "", killedByUser},
+		{"Bad selector", &Options{Selector: "app in (web"}, kc, 0, "unable to parse requirement: found '', expected: ',' or ')'", ""},
+		{"No cluster", nil, nil, 0, errNoCluster.Error(), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := make(chan *Message, 10)
+			p := startLogs("l", dest, tt.opt, nil, tt.client)
+			for i := 0; i < tt.wantLogs; i++ {
+				if m := <-dest; m.Kind != "log" || m.Body != "[pod/web-1/nginx] fake logs\n" || m.Log.Container != "nginx" {
+					t.Fatalf("got %+v, want a log of web-1/nginx", m)
+				}
+			}
+			if tt.wantBy != "" {
+				// Logs are followed until killed.
+				go p.Kill()
+			}
+			m := <-dest
+			if m.Kind != "end" || m.Body != tt.wantEnd {
+				t.Fatalf("got %s %q, want end %q", m.Kind, m.Body, tt.wantEnd)
+			}
+			if m.Exit.KilledBy != tt.wantBy {
+				t.Errorf("got end killed by %q, want %q", m.Exit.KilledBy, tt.wantBy)
+			}
+		})
+	}
+}
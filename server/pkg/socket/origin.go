@@ -0,0 +1,150 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// originPattern is a parsed --allowed-origin value of the form
+// [scheme://]host[:port]. The host may be "*" to match any host, or start
+// with "*." to match any subdomain. An empty scheme matches both http and
+// https, and an empty port matches the default port of the scheme.
+type originPattern struct {
+	scheme string
+	host   string
+	port   string
+}
+
+// parseOriginPattern parses an allowed origin pattern.
+func parseOriginPattern(s string) (originPattern, error) {
+	raw := s
+	if !strings.Contains(s, "://") {
+		raw = "//" + s
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return originPattern{}, fmt.Errorf("invalid allowed origin %q: %w", s, err)
+	}
+	if u.Hostname() == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return originPattern{}, fmt.Errorf("invalid allowed origin %q: want [scheme://]host[:port]", s)
+	}
+	switch u.Scheme {
+	case "", "http", "https":
+	default:
+		return originPattern{}, fmt.Errorf("invalid allowed origin %q: unsupported scheme %q", s, u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host != "*" && strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return originPattern{}, fmt.Errorf("invalid allowed origin %q: wildcard must be the leftmost label", s)
+	}
+	return originPattern{scheme: u.Scheme, host: host, port: u.Port()}, nil
+}
+
+// match reports whether the origin o is covered by the pattern.
+func (p originPattern) match(o *url.URL) bool {
+	scheme := strings.ToLower(o.Scheme)
+	if p.scheme != "" && p.scheme != scheme {
+		return false
+	}
+	if scheme != "http" && scheme != "https" {
+		return false
+	}
+	want := p.port
+	if want == "" {
+		want = defaultPort(scheme)
+	}
+	if originPort(o) != want {
+		return false
+	}
+	host := strings.ToLower(o.Hostname())
+	switch {
+	case p.host == "*":
+		return true
+	case strings.HasPrefix(p.host, "*."):
+		return strings.HasSuffix(host, p.host[1:]) && len(host) > len(p.host)-1
+	default:
+		return host == p.host
+	}
+}
+
+// originChecker decides which websocket origins may connect. The server's
+// own origin, built from its listening address, is always allowed.
+type originChecker struct {
+	self    *url.URL
+	allowed []originPattern
+}
+
+func newOriginChecker(self *url.URL, allowed []string) (*originChecker, error) {
+	c := &originChecker{self: self}
+	for _, s := range allowed {
+		p, err := parseOriginPattern(s)
+		if err != nil {
+			return nil, err
+		}
+		c.allowed = append(c.allowed, p)
+	}
+	return c, nil
+}
+
+// check returns a descriptive error if the origin o may not connect.
+func (c *originChecker) check(o *url.URL) error {
+	if o == nil {
+		return fmt.Errorf("missing origin")
+	}
+	if c.isSelf(o) {
+		return nil
+	}
+	for _, p := range c.allowed {
+		if p.match(o) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %q does not match %q or any allowed origin", o, c.self)
+}
+
+// isSelf reports whether o is the origin the server itself is served from.
+// An address without a host (eg: ":8080") listens on every interface, so
+// loopback origins on the same port are treated as the server's own.
+func (c *originChecker) isSelf(o *url.URL) bool {
+	if c.self == nil || !strings.EqualFold(c.self.Scheme, o.Scheme) || originPort(c.self) != originPort(o) {
+		return false
+	}
+	host := strings.ToLower(o.Hostname())
+	if self := strings.ToLower(c.self.Hostname()); self != "" {
+		return host == self
+	}
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// originPort returns the port of u, falling back to the scheme default.
+func originPort(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	return defaultPort(strings.ToLower(u.Scheme))
+}
+
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		allowed []string
+		origin  string
+		wantErr bool
+	}{
+		{
+			"Localhost - same origin",
+			"localhost:8080",
+			nil,
+			"http://localhost:8080",
+			false,
+		},
+		{
+			"Localhost - all interfaces",
+			":8082",
+			nil,
+			"http://127.0.0.1:8082",
+			false,
+		},
+		{
+			"Localhost - port mismatch",
+			"localhost:8080",
+			nil,
+			"http://localhost:3000",
+			true,
+		},
+		{
+			"Localhost - dev server allowed",
+			"localhost:8080",
+			[]string{"http://localhost:3000"},
+			"http://localhost:3000",
+			false,
+		},
+		{
+			"Proxied hostname - allowed",
+			":8082",
+			[]string{"slides.rquitales.com"},
+			"http://slides.rquitales.com",
+			false,
+		},
+		{
+			"Proxied hostname - wildcard",
+			":8082",
+			[]string{"https://*.rquitales.com"},
+			"https://slides.rquitales.com",
+			false,
+		},
+		{
+			"Proxied hostname - wildcard does not match apex",
+			":8082",
+			[]string{"https://*.rquitales.com"},
+			"https://rquitales.com",
+			true,
+		},
+		{
+			"Proxied hostname - scheme mismatch",
+			":8082",
+			[]string{"https://*.rquitales.com"},
+			"http://slides.rquitales.com",
+			true,
+		},
+		{
+			"Proxied hostname - port mismatch",
+			":8082",
+			[]string{"slides.rquitales.com"},
+			"http://slides.rquitales.com:8088",
+			true,
+		},
+		{
+			"Proxied hostname - explicit port",
+			":8082",
+			[]string{"http://slides.rquitales.com:8088"},
+			"http://slides.rquitales.com:8088",
+			false,
+		},
+		{
+			"Unknown origin",
+			"localhost:8080",
+			[]string{"https://*.rquitales.com"},
+			"https://evil.example.com",
+			true,
+		},
+		{
+			"Suffix is not a subdomain",
+			"localhost:8080",
+			[]string{"https://*.rquitales.com"},
+			"https://evilrquitales.com",
+			true,
+		},
+		{
+			"Missing origin",
+			"localhost:8080",
+			nil,
+			"",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			self := &url.URL{Scheme: "http", Host: tt.addr}
+			oc, err := newOriginChecker(self, tt.allowed)
+			if err != nil {
+				t.Fatalf("newOriginChecker() error = %v", err)
+			}
+			req := httptest.NewRequest("GET", "/socket", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			c := &websocket.Config{Origin: self, Version: websocket.ProtocolVersionHybi13}
+			err = checkOrigin(oc, c, req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkOrigin() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseOriginPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr bool
+	}{
+		{"http://localhost:3000", false},
+		{"slides.rquitales.com", false},
+		{"https://*.rquitales.com", false},
+		{"*", false},
+		{"ftp://slides.rquitales.com", true},
+		{"https://slides.*.com", true},
+		{"https://slides.rquitales.com/path", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			_, err := parseOriginPattern(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseOriginPattern() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"strings"
+
+	"github.com/rquitales/go-presentation-server/pkg/k8s"
+	"github.com/rquitales/go-presentation-server/pkg/policy"
+)
+
+// controlKind reports whether messages of kind only control already running
+// processes, rather than start one.
+func controlKind(kind string) bool {
+	switch kind {
+	case "kill", "stdin", "eof", "resize", "resetSession", "resume":
+		return true
+	}
+	return false
+}
+
+// checkPolicy returns an error if the policy denies the message. Messages
+// which only control already running processes are always allowed.
+// Kubernetes objects which don't set a namespace are checked as being in
+// namespace, the one the client puts them in.
+func checkPolicy(p *policy.Policy, m *Message, namespace string) error {
+	if controlKind(m.Kind) {
+		return nil
+	}
+	if err := p.AllowKind(m.Kind); err != nil {
+		return err
+	}
+	switch {
+	case m.Kind == "run":
+		if path, args := shebang(m.Body); path != "" {
+			return p.AllowInterpreter(path, args)
+		}
+	case m.Kind == "saveFile":
+		return p.AllowSavePath(m.Path)
+	case strings.HasPrefix(m.Kind, "kubectl"):
+		return allowManifest(p, m.Body, namespace)
+	case m.Kind == "watch":
+		var kind string
+		if m.Options != nil {
+			kind = m.Options.Kind
+			if m.Options.Namespace != "" {
+				namespace = m.Options.Namespace
+			}
+		}
+		return p.AllowObjects(kind, namespace)
+	case m.Kind == "logs":
+		if m.Options != nil && m.Options.Namespace != "" {
+			namespace = m.Options.Namespace
+		}
+		return p.AllowObjects("Pod", namespace)
+	}
+	return nil
+}
+
+// allowManifest returns an error if the policy denies any of the objects of
+// a manifest. The manifest is decoded as it is when run, so the objects
+// checked are the ones kubectl messages touch.
+func allowManifest(p *policy.Policy, manifest, namespace string) error {
+	if p == nil {
+		return nil
+	}
+	objs, err := k8s.Decode(manifest)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		ns := obj.GetNamespace()
+		if ns == "" {
+			ns = namespace
+		}
+		if err := p.AllowObjects(obj.GetKind(), ns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
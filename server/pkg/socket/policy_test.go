@@ -0,0 +1,67 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"testing"
+
+	"github.com/rquitales/go-presentation-server/pkg/policy"
+)
+
+func TestCheckPolicy(t *testing.T) {
+	pol, err := policy.Parse([]byte("kubectl:\n  namespaces: [default, demo]\n  resources: [ConfigMap, Deployment, Pod]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const manifest = "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n"
+	tests := []struct {
+		name      string
+		m         *Message
+		namespace string // the client's
+		wantErr   bool
+	}{
+		{"Manifest in default namespace", &Message{Kind: "kubectlApply", Body: manifest}, "default", false},
+		{"Manifest in client namespace", &Message{Kind: "kubectlApply", Body: manifest}, "kube-system", true},
+		{
+			"Multiple documents",
+			&Message{Kind: "kubectlApply", Body: "# leading comment\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  namespace: demo\n---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  namespace: demo\n"},
+			"default",
+			false,
+		},
+		{"Disallowed namespace", &Message{Kind: "kubectlApply", Body: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  namespace: kube-system\n"}, "default", true},
+		{"Disallowed kind in second document", &Message{Kind: "kubectlDelete", Body: manifest + "---\napiVersion: rbac.authorization.k8s.io/v1\nkind: ClusterRoleBinding\n"}, "default", true},
+		{"Disallowed kind in list", &Message{Kind: "kubectlApply", Body: "apiVersion: v1\nkind: List\nitems:\n- apiVersion: v1\n  kind: ConfigMap\n- apiVersion: v1\n  kind: Secret\n"}, "default", true},
+		{
+			"Non-list object carrying items",
+			&Message{Kind: "kubectlApply", Body: "apiVersion: apps/v1\nkind: Deployment\nitems:\n- apiVersion: v1\n  kind: Secret\n  metadata:\n    namespace: kube-system\n"},
+			"default",
+			true,
+		},
+		{"Missing kind", &Message{Kind: "kubectlApply", Body: "apiVersion: v1\nmetadata:\n  name: a\n"}, "default", true},
+		{"Watch in client namespace", &Message{Kind: "watch", Options: &Options{Kind: "ConfigMap"}}, "kube-system", true},
+		{"Watch in allowed namespace", &Message{Kind: "watch", Options: &Options{Kind: "ConfigMap", Namespace: "default"}}, "kube-system", false},
+		{"Logs in client namespace", &Message{Kind: "logs"}, "kube-system", true},
+		{"Logs in allowed namespace", &Message{Kind: "logs", Options: &Options{Namespace: "default"}}, "kube-system", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPolicy(pol, tt.m, tt.namespace)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
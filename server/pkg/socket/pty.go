@@ -0,0 +1,128 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/creack/pty"
+	exec "golang.org/x/sys/execabs"
+)
+
+const (
+	// Terminal size used when the client doesn't send one.
+	defaultRows = 24
+	defaultCols = 80
+
+	// How long to wait for buffered terminal output after the process
+	// exits, in case a background process still holds the terminal open.
+	ttyDrain = time.Second
+)
+
+// startTTY starts cmd under a pseudo-terminal in its own session, streaming
+// the raw terminal output as "stdout" messages. "stdin" messages are sent
+// to the terminal as keystrokes. cmd.Env must already set TERM.
+func (p *process) startTTY(cmd *exec.Cmd, opt *Options, input <-chan string) error {
+	tty, err := pty.StartWithSize(cmd, winsize(opt))
+	if err != nil {
+		return err
+	}
+	p.tty = tty
+	p.ttyDone = make(chan struct{})
+	go p.copyTTY()
+
+	go copyInput(ttyInput{tty}, input, p.done)
+	return nil
+}
+
+// copyTTY sends the terminal output as "stdout" messages, taking care not
+// to split UTF-8 sequences across messages.
+func (p *process) copyTTY() {
+	defer close(p.ttyDone)
+	w := &messageWriter{kind: "stdout", out: p.out, tty: true}
+	buf := make([]byte, 32*1024)
+	n := 0
+	for {
+		r, err := p.tty.Read(buf[n:])
+		n += r
+		if i := validPrefix(buf[:n]); i > 0 {
+			w.Write(buf[:i])
+			n = copy(buf, buf[i:n])
+		}
+		if err != nil {
+			if n > 0 {
+				w.Write(buf[:n])
+			}
+			return
+		}
+	}
+}
+
+// closeTTY waits for the remaining terminal output to be sent and closes
+// the terminal. It must be called once the process has exited.
+func (p *process) closeTTY() {
+	if p.tty == nil {
+		return
+	}
+	select {
+	case <-p.ttyDone:
+	case <-time.After(ttyDrain):
+	}
+	p.tty.Close()
+	<-p.ttyDone
+}
+
+// resize changes the terminal size of the process, if it has one.
+func (p *process) resize(opt *Options) {
+	if p == nil || p.tty == nil {
+		return
+	}
+	pty.Setsize(p.tty, winsize(opt))
+}
+
+func winsize(opt *Options) *pty.Winsize {
+	ws := &pty.Winsize{Rows: defaultRows, Cols: defaultCols}
+	if opt != nil && opt.Rows > 0 && opt.Cols > 0 {
+		ws.Rows, ws.Cols = opt.Rows, opt.Cols
+	}
+	return ws
+}
+
+// validPrefix returns the length of b without a trailing incomplete UTF-8
+// sequence.
+func validPrefix(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+	return len(b)
+}
+
+// ttyInput writes keystrokes to a terminal. Closing it sends end of file
+// (Ctrl-D) rather than closing the terminal.
+type ttyInput struct {
+	*os.File
+}
+
+func (t ttyInput) Close() error {
+	_, err := t.Write([]byte{4})
+	return err
+}
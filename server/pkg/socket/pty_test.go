@@ -0,0 +1,126 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rquitales/go-presentation-server/pkg/policy"
+	"golang.org/x/net/websocket"
+)
+
+func TestPTY(t *testing.T) {
+	dial, cleanup := newTestServer(t)
+	defer cleanup()
+	ws, err := dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	body := "#!/bin/sh\ntest -t 0 && test -t 1 && echo tty\nstty size\nread x\nstty size"
+	websocket.JSON.Send(ws, &Message{Id: "tty", Kind: "run", Body: body, Options: &Options{PTY: true, Rows: 30, Cols: 100}})
+	// Give the script time to print the initial size before resizing.
+	time.Sleep(200 * time.Millisecond)
+	websocket.JSON.Send(ws, &Message{Id: "tty", Kind: "resize", Options: &Options{Rows: 40, Cols: 120}})
+	websocket.JSON.Send(ws, &Message{Id: "tty", Kind: "stdin", Body: "\r"})
+
+	out, end := receiveUntilEnd(t, ws, "tty")
+	out = strings.ReplaceAll(out, "\r\n", "\n")
+	if want := "tty\n30 100\n\n40 120\n"; out != want || end.Body != "" {
+		t.Errorf("got stdout %q, end %q; want stdout %q", out, end.Body, want)
+	}
+}
+
+func TestPTYSandbox(t *testing.T) {
+	pol, err := policy.Parse([]byte("sandbox:\n  shell: {}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial, cleanup := newTestServerConfig(t, Config{Policy: pol})
+	defer cleanup()
+	ws, err := dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	// The script runs as the sandbox's first process, in a terminal.
+	body := "#!/bin/sh\ntest -t 1 && echo tty\necho pid=$$ term=$TERM"
+	websocket.JSON.Send(ws, &Message{Id: "tty", Kind: "run", Body: body, Options: &Options{PTY: true}})
+	out, end := receiveUntilEnd(t, ws, "tty")
+	if strings.Contains(end.Body, "operation not permitted") {
+		t.Skipf("user namespaces unavailable: %s", end.Body)
+	}
+	out = strings.ReplaceAll(out, "\r\n", "\n")
+	if want := "tty\npid=1 term=xterm-256color\n"; out != want || end.Body != "" {
+		t.Errorf("got stdout %q, end %q; want stdout %q", out, end.Body, want)
+	}
+}
+
+func TestPTYKill(t *testing.T) {
+	dial, cleanup := newTestServer(t)
+	defer cleanup()
+	ws, err := dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	body := "#!/bin/sh\nsleep 100 &\necho started\nsleep 100"
+	websocket.JSON.Send(ws, &Message{Id: "tty", Kind: "run", Body: body, Options: &Options{PTY: true}})
+	time.Sleep(200 * time.Millisecond)
+	websocket.JSON.Send(ws, &Message{Id: "tty", Kind: "kill"})
+
+	start := time.Now()
+	if _, end := receiveUntilEnd(t, ws, "tty"); !strings.Contains(end.Body, "killed") {
+		t.Errorf("end body = %q, want killed", end.Body)
+	}
+	// The background sleep must not keep the terminal, and so the
+	// process, alive.
+	if d := time.Since(start); d > ttyDrain/2 {
+		t.Errorf("process took %v to end after kill", d)
+	}
+}
+
+func TestPTYKeystrokes(t *testing.T) {
+	dial, cleanup := newTestServer(t)
+	defer cleanup()
+	ws, err := dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	// Each keystroke is echoed by the terminal in a message of its own,
+	// which mustn't count towards the output limit.
+	body := "#!/bin/sh\nread x\necho ${#x}"
+	websocket.JSON.Send(ws, &Message{Id: "tty", Kind: "run", Body: body, Options: &Options{PTY: true}})
+	time.Sleep(200 * time.Millisecond)
+	const keystrokes = msgLimit + 100
+	for i := 0; i < keystrokes; i++ {
+		websocket.JSON.Send(ws, &Message{Id: "tty", Kind: "stdin", Body: "a"})
+		time.Sleep(time.Millisecond)
+	}
+	websocket.JSON.Send(ws, &Message{Id: "tty", Kind: "stdin", Body: "\r"})
+
+	out, end := receiveUntilEnd(t, ws, "tty")
+	if end.Body != "" || !strings.HasSuffix(out, "\r\n"+strconv.Itoa(keystrokes)+"\r\n") {
+		t.Errorf("got %d bytes of stdout, end %q; want %d keystrokes read", len(out), end.Body, keystrokes)
+	}
+}
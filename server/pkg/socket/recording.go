@@ -0,0 +1,197 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Recordings saves the messages sent by each process to disk, or replays
+// them instead of running anything, so that a presentation can be given
+// without the network or clusters its demos depend on.
+type Recordings struct {
+	dir    string
+	replay bool
+}
+
+// NewRecordings returns recordings kept in dir. In replay mode, processes
+// are never run and dir must already hold their recordings.
+func NewRecordings(dir string, replay bool) (*Recordings, error) {
+	if replay {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("recordings must be a directory: %q", dir)
+		}
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create recording directory: %w", err)
+	}
+	return &Recordings{dir: dir, replay: replay}, nil
+}
+
+// recording is the output of a process, saved as JSON.
+type recording struct {
+	Id       string
+	Kind     string
+	Body     string
+	Messages []recordedMessage
+}
+
+// recordedMessage is a message sent by a process, along with when it was
+// sent, in seconds since the process started.
+type recordedMessage struct {
+	Time    float64
+	Message *Message
+}
+
+// path returns the file the recording of the snippet started by m is kept
+// in, named after its Id and the hash of its kind and body, as the same
+// snippet may be both applied and deleted, say.
+func (r *Recordings) path(m *Message) string {
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, m.Id)
+	h := sha256.Sum256([]byte(m.Kind + "\x00" + m.Body))
+	return filepath.Join(r.dir, id+"-"+hex.EncodeToString(h[:8])+".json")
+}
+
+// replaying reports whether processes are replayed rather than run.
+func (r *Recordings) replaying() bool {
+	return r != nil && r.replay
+}
+
+// save writes rec to disk.
+func (r *Recordings) save(rec *recording) error {
+	b, err := json.MarshalIndent(rec, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.path(&Message{Id: rec.Id, Kind: rec.Kind, Body: rec.Body}), b, 0644)
+}
+
+// load reads the recording of the snippet started by m.
+func (r *Recordings) load(m *Message) (*recording, error) {
+	b, err := ioutil.ReadFile(r.path(m))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no recording of this %s", m.Kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec recording
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, fmt.Errorf("invalid recording: %w", err)
+	}
+	return &rec, nil
+}
+
+// tee returns the channel the process started by m should send its
+// messages on. Unless recording, that is next itself. Otherwise, messages
+// are passed on to next and saved once the "end" message is sent. next must
+// keep receiving until then.
+func (r *Recordings) tee(m *Message, next chan<- *Message) chan<- *Message {
+	if r == nil || r.replay {
+		return next
+	}
+	in := make(chan *Message)
+	rec := &recording{Id: m.Id, Kind: m.Kind, Body: m.Body}
+	start := time.Now()
+	go func() {
+		for m := range in {
+			rec.Messages = append(rec.Messages, recordedMessage{Time: time.Since(start).Seconds(), Message: m})
+			next <- m
+			if m.Kind == "end" {
+				break
+			}
+		}
+		if len(rec.Messages) == 0 {
+			return
+		}
+		if err := r.save(rec); err != nil {
+			log.Printf("unable to save recording of %s: %v", rec.Id, err)
+		}
+	}()
+	return in
+}
+
+// replay sends the messages of a recorded process.
+type replay struct {
+	stop chan struct{} // closed to stop the replay
+	done chan struct{} // closed once the replay has ended
+}
+
+// startReplay replays the recording of the snippet started by m on out,
+// with its original pacing.
+func (r *Recordings) startReplay(m *Message, out chan<- *Message) *replay {
+	rec, err := r.load(m)
+	if err != nil {
+		out <- failed(m.Id, err)
+		return nil
+	}
+	p := &replay{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		start := time.Now()
+		var seq uint64
+		for _, rm := range rec.Messages {
+			msg := rm.Message
+			seq++
+			msg.Id, msg.Seq = m.Id, seq
+			t := time.NewTimer(time.Until(start.Add(time.Duration(rm.Time * float64(time.Second)))))
+			select {
+			case now := <-t.C:
+				msg.Time = millis(now)
+				out <- msg
+			case <-p.stop:
+				t.Stop()
+				out <- &Message{Id: m.Id, Kind: "end", Body: "signal: killed", Seq: seq, Time: millis(time.Now()), Exit: &Exit{
+					Code:     -1,
+					Signal:   "SIGKILL",
+					Phase:    phaseRun,
+					Duration: time.Since(start).Seconds(),
+					KilledBy: killedByUser,
+				}}
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Kill stops the replay, sending an "end" message as if the process had
+// been killed if it hadn't ended yet.
+func (p *replay) Kill() {
+	if p == nil {
+		return
+	}
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	close(p.stop)
+	<-p.done
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestRecordReplay(t *testing.T) {
+	dir, marker := t.TempDir(), filepath.Join(t.TempDir(), "ran")
+	slow := "#!/bin/sh\ntouch " + marker + "\nprintf 'one '\nsleep 0.5\necho two"
+
+	// Record the snippet.
+	rec, err := NewRecordings(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial, cleanup := newTestServerConfig(t, Config{Recordings: rec})
+	ws, err := dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	websocket.JSON.Send(ws, &Message{Id: "demo", Kind: "run", Body: slow})
+	if out, end := receiveUntilEnd(t, ws, "demo"); out != "one two\n" || end.Body != "" {
+		t.Fatalf("record: got stdout %q, end %q", out, end.Body)
+	}
+	ws.Close()
+	cleanup()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("got %d recordings, want 1", len(files))
+	}
+	os.Remove(marker)
+
+	// Replay it, without running anything.
+	rep, err := NewRecordings(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial, cleanup = newTestServerConfig(t, Config{Recordings: rep})
+	defer cleanup()
+	ws, err = dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	tests := []struct {
+		name     string
+		kind     string
+		body     string
+		kill     bool
+		wantOut  string
+		wantEnd  string
+		wantTime time.Duration // at least
+	}{
+		{"Replay", "run", slow, false, "one two\n", "", 500 * time.Millisecond},
+		{"Kill", "run", slow, true, "one ", "signal: killed", 0},
+		{"Not recorded", "run", "#!/bin/sh\necho three", false, "", "no recording of this run", 0},
+		{"Other kind", "test", slow, false, "", "no recording of this test", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			websocket.JSON.Send(ws, &Message{Id: "demo", Kind: tt.kind, Body: tt.body})
+			if tt.kill {
+				time.Sleep(250 * time.Millisecond)
+				websocket.JSON.Send(ws, &Message{Id: "demo", Kind: "kill"})
+			}
+			out, end := receiveUntilEnd(t, ws, "demo")
+			if out != tt.wantOut || end.Body != tt.wantEnd {
+				t.Errorf("got stdout %q, end %q, want %q, %q", out, end.Body, tt.wantOut, tt.wantEnd)
+			}
+			if tt.kill && end.Exit.KilledBy != "user" {
+				t.Errorf("got killed by %q, want user", end.Exit.KilledBy)
+			}
+			if took := time.Since(start); took < tt.wantTime {
+				t.Errorf("replay took %v, want at least %v", took, tt.wantTime)
+			}
+		})
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("snippet was run while replaying")
+	}
+}
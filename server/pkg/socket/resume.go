@@ -0,0 +1,173 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var errNothingToResume = errors.New("nothing to resume")
+
+// The number of recent messages kept per process for connections resuming
+// it.
+const ringSize = 500
+
+// relay passes the messages of a process on to the connection it is
+// attached to, keeping the most recent ones, so that a connection which
+// dropped can resume after the last Seq it received.
+type relay struct {
+	id string
+	in chan<- *Message // the process' messages
+
+	mu   sync.Mutex
+	out  chan<- *Message // the attached connection, nil while detached
+	ring []*Message      // the last ringSize messages
+}
+
+// newRelay returns a relay for the process with the given id, attached to
+// out. Closing in before any message is sent stops it.
+func newRelay(id string, out chan<- *Message) *relay {
+	in := make(chan *Message)
+	r := &relay{id: id, in: in, out: out}
+	go func() {
+		for m := range in {
+			r.mu.Lock()
+			r.ring = append(r.ring, m)
+			if len(r.ring) > ringSize {
+				r.ring = append(r.ring[:0], r.ring[1:]...)
+			}
+			// Sending while locked ensures no message is sent once
+			// detached. Connections always receive until they are closed.
+			if r.out != nil {
+				r.out <- m
+			}
+			r.mu.Unlock()
+			if m.Kind == "end" {
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// detach stops sending messages to the connection, which may then be closed.
+func (r *relay) detach() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.out = nil
+}
+
+// attach resends the messages after seq on out, then sends it the
+// following ones. A "resumed" message, without a Seq of its own, is sent
+// first, saying how many were lost if they are no longer kept.
+func (r *relay) attach(out chan<- *Message, seq uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resumed := &Message{Id: r.id, Kind: "resumed", Time: millis(time.Now())}
+	if len(r.ring) > 0 {
+		if first := r.ring[0].Seq; seq+1 < first {
+			resumed.Body = fmt.Sprintf("%d messages were lost", first-seq-1)
+		}
+	}
+	out <- resumed
+	for _, m := range r.ring {
+		if m.Seq > seq {
+			out <- m
+		}
+	}
+	r.out = out
+}
+
+// detachKey identifies a detached process by the presentation session its
+// connection joined and its Id.
+type detachKey struct {
+	session string
+	id      string
+}
+
+// detached is a process, and its shell session, left running after its
+// connection dropped, to be resumed by another connection within the grace
+// period.
+type detached struct {
+	relay   *relay
+	proc    *process
+	session *session
+	timer   *time.Timer
+}
+
+// detach keeps the processes of a connection to sessionName running for
+// the grace period, after which they are killed unless resumed.
+func (h *handler) detach(sessionName string, relays map[string]*relay, proc map[string]*process, sessions map[string]*session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, r := range relays {
+		r.detach()
+		key := detachKey{session: sessionName, id: id}
+		if old := h.detached[key]; old != nil {
+			// Another connection dropped with the same Id.
+			old.timer.Stop()
+			go old.kill()
+		}
+		d := &detached{relay: r, proc: proc[id], session: sessions[id]}
+		d.timer = time.AfterFunc(h.grace, func() { h.expire(key, d) })
+		h.detached[key] = d
+	}
+	// Sessions with no runs since they were reset are no use to resume.
+	for id, s := range sessions {
+		if relays[id] == nil {
+			s.close()
+		}
+	}
+}
+
+// expire kills a detached process which wasn't resumed in time.
+func (h *handler) expire(key detachKey, d *detached) {
+	h.mu.Lock()
+	if h.detached[key] != d {
+		h.mu.Unlock()
+		return // resumed
+	}
+	delete(h.detached, key)
+	h.mu.Unlock()
+	log.Printf("killing %q, which was not resumed", key.id)
+	d.kill()
+}
+
+func (d *detached) kill() {
+	d.proc.Kill()
+	d.session.close()
+}
+
+// resume returns the process detached from a connection to sessionName
+// with the given id, or nil if there is none.
+func (h *handler) resume(sessionName, id string) *detached {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := detachKey{session: sessionName, id: id}
+	d := h.detached[key]
+	if d == nil {
+		return nil
+	}
+	d.timer.Stop()
+	delete(h.detached, key)
+	return d
+}
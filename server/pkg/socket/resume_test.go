@@ -0,0 +1,178 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestResume(t *testing.T) {
+	tests := []struct {
+		name     string
+		grace    time.Duration
+		id       string        // to resume
+		wait     time.Duration // before resuming
+		wantOut  string
+		wantEnd  string
+		wantKind string // of the first message after resuming
+	}{
+		{"Resumed", time.Minute, "p", 0, "two\n", "", "resumed"},
+		{"Unknown Id", time.Minute, "q", 0, "", "nothing to resume", "end"},
+		{"Grace period over", 100 * time.Millisecond, "p", 500 * time.Millisecond, "", "nothing to resume", "end"},
+		{"Killed on disconnect", 0, "p", 0, "", "nothing to resume", "end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dial, cleanup := newTestServerConfig(t, Config{ResumeGrace: tt.grace})
+			defer cleanup()
+
+			ws, err := dial("token=" + testToken)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			ws.SetDeadline(time.Now().Add(10 * time.Second))
+			websocket.JSON.Send(ws, &Message{Id: "p", Kind: "run", Body: "#!/bin/sh\necho one\nsleep 1\necho two"})
+			var m Message
+			for m.Kind != "stdout" {
+				if err := websocket.JSON.Receive(ws, &m); err != nil {
+					t.Fatalf("receive: %v", err)
+				}
+			}
+			if m.Seq == 0 {
+				t.Fatalf("got %+v without a sequence number", m)
+			}
+			ws.Close()
+			time.Sleep(tt.wait)
+
+			ws, err = dial("token=" + testToken)
+			if err != nil {
+				t.Fatalf("redial: %v", err)
+			}
+			defer ws.Close()
+			ws.SetDeadline(time.Now().Add(10 * time.Second))
+			websocket.JSON.Send(ws, &Message{Id: tt.id, Kind: "resume", Seq: m.Seq})
+			var first Message
+			if err := websocket.JSON.Receive(ws, &first); err != nil {
+				t.Fatalf("receive: %v", err)
+			}
+			if first.Kind != tt.wantKind || first.Seq != 0 {
+				t.Fatalf("got %+v after resuming, want an unnumbered %q message", first, tt.wantKind)
+			}
+			if first.Kind == "end" {
+				if first.Body != tt.wantEnd {
+					t.Errorf("got end %q, want %q", first.Body, tt.wantEnd)
+				}
+				return
+			}
+			out, end := receiveUntilEnd(t, ws, tt.id)
+			if out != tt.wantOut || end.Body != tt.wantEnd {
+				t.Errorf("got stdout %q and end %q, want %q and %q", out, end.Body, tt.wantOut, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestResumeReplacing(t *testing.T) {
+	dial, cleanup := newTestServerConfig(t, Config{ResumeGrace: time.Minute})
+	defer cleanup()
+
+	ws, err := dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	ws.SetDeadline(time.Now().Add(10 * time.Second))
+	websocket.JSON.Send(ws, &Message{Id: "p", Kind: "run", Body: "#!/bin/sh\necho one\nsleep 1\necho two"})
+	var m Message
+	for m.Kind != "stdout" {
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+	}
+	ws.Close()
+
+	// The new connection runs a process under the same Id, which resuming
+	// the first one kills.
+	ws, err = dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("redial: %v", err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(10 * time.Second))
+	websocket.JSON.Send(ws, &Message{Id: "p", Kind: "run", Body: "#!/bin/sh\necho other\nsleep 60"})
+	for m = (Message{}); m.Kind != "stdout"; {
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+	}
+	websocket.JSON.Send(ws, &Message{Id: "p", Kind: "resume", Seq: 1})
+	for m = (Message{}); m.Kind != "resumed"; {
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		if m.Kind == "end" {
+			t.Fatalf("got end %+v of the replaced process", m)
+		}
+	}
+	out, end := receiveUntilEnd(t, ws, "p")
+	if out != "two\n" || end.Body != "" {
+		t.Errorf("got stdout %q and end %q, want %q and %q", out, end.Body, "two\n", "")
+	}
+}
+
+func TestRelayAttach(t *testing.T) {
+	tests := []struct {
+		name     string
+		sent     int    // stdout messages sent before "end"
+		seq      uint64 // last one received
+		want     int    // stdout messages resent
+		wantLost string
+	}{
+		{"None missed", 3, 3, 0, ""},
+		{"Some missed", 3, 1, 2, ""},
+		{"Too many missed", ringSize + 9, 0, ringSize - 1, "10 messages were lost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := make(chan *Message)
+			r := newRelay("t", live)
+			go func() {
+				for i := 1; i <= tt.sent; i++ {
+					r.in <- &Message{Id: "t", Kind: "stdout", Body: "x", Seq: uint64(i)}
+				}
+				r.in <- &Message{Id: "t", Kind: "end", Seq: uint64(tt.sent + 1)}
+			}()
+			for (<-live).Kind != "end" {
+			}
+			r.detach()
+
+			out := make(chan *Message, ringSize+2)
+			r.attach(out, tt.seq)
+			resumed := <-out
+			if resumed.Kind != "resumed" || resumed.Body != tt.wantLost || resumed.Seq != 0 {
+				t.Errorf("got %+v, want a resumed message saying %q", resumed, tt.wantLost)
+			}
+			got := 0
+			for m := <-out; m.Kind != "end"; m = <-out {
+				got++
+			}
+			if got != tt.want {
+				t.Errorf("got %d messages resent, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setCPULimit limits the CPU time of the process pid and the children it
+// starts from now on. The kernel sends SIGXCPU once the limit is reached,
+// and SIGKILL a second later.
+func setCPULimit(pid int, d time.Duration) error {
+	secs := uint64((d + time.Second - 1) / time.Second)
+	return unix.Prlimit(pid, unix.RLIMIT_CPU, &unix.Rlimit{Cur: secs, Max: secs + 1}, nil)
+}
@@ -16,24 +16,14 @@ package socket
 
 import (
 	"io/ioutil"
-	"time"
+
+	"github.com/rquitales/go-presentation-server/pkg/policy"
 )
 
 // startKubectl saves a yaml file and runs the specified kubectl action on the yaml file,
 // sending its output and end event as Messages on the provided channel.
-func startSaveFile(id, path, body string, dest chan<- *Message, opt *Options) *process {
-	var (
-		done = make(chan struct{})
-		out  = make(chan *Message)
-		p    = &process{out: out, done: done}
-	)
-	go func() {
-		defer close(done)
-		for m := range buffer(limiter(out, p), time.After) {
-			m.Id = id
-			dest <- m
-		}
-	}()
+func startSaveFile(id, path, body string, dest chan<- *Message, opt *Options, pol *policy.Policy) *process {
+	p := newProcess(id, "", dest, opt, pol)
 
 	err := p.startSaveFile(path, body, opt)
 	if err != nil {
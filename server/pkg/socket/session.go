@@ -0,0 +1,398 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/rquitales/go-presentation-server/pkg/policy"
+	"github.com/rquitales/go-presentation-server/pkg/sandbox"
+	exec "golang.org/x/sys/execabs"
+)
+
+// shells are the interpreters whose snippets run in a session.
+var shells = map[string]bool{
+	"sh": true, "bash": true, "zsh": true, "dash": true, "ash": true, "ksh": true, "mksh": true,
+}
+
+var errSessionEnded = errors.New("session ended")
+
+// sessionLoop is run by the shell of a session. It reads the commands for
+// each run from file descriptor 3, leaving standard input to the snippets.
+const sessionLoop = `while IFS= read -r __present_cmd <&3; do eval "$__present_cmd"; done`
+
+// isShell reports whether the shebang runs a shell.
+func isShell(path string, args []string) bool {
+	if filepath.Base(path) == "env" && len(args) > 1 {
+		path = args[1]
+	}
+	return shells[filepath.Base(path)]
+}
+
+// session is a long-lived shell running successive snippets sent with the
+// same Id, so that the working directory, environment variables and shell
+// functions carry over from one run to the next.
+//
+// Each run sources the snippet from a script file, then prints a marker
+// line with the exit status and working directory on both stdout and
+// stderr. Output is routed to the process for the current run until both
+// markers have been seen.
+type session struct {
+	args    []string
+	cmd     *exec.Cmd
+	cmds    *os.File // the shell reads a command line for each run from it
+	stdin   io.WriteCloser
+	dir     string // holds the script files
+	marker  []byte
+	exited  chan struct{} // closed once the shell has exited
+	cleanup func()        // releases the sandbox, if any
+	sandbox bool          // whether the shell runs in a sandbox
+
+	mu     sync.Mutex
+	n      int      // number of runs, used to name scripts
+	cur    *process // the current run, if any
+	seen   int      // number of markers seen for the current run
+	status string   // exit status of the current run
+	wd     string   // working directory of the shell after the last run
+	ended  bool     // set once the shell's standard input is closed
+}
+
+// startSession starts a shell session with the interpreter and arguments of
+// a shebang.
+func startSession(args []string, pol *policy.Policy) (*session, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "present-session-")
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		args:   args,
+		dir:    dir,
+		marker: []byte("\n__present_" + hex.EncodeToString(b) + ":"),
+		exited: make(chan struct{}),
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	defer r.Close()
+	s.cmds = w
+
+	stdout, stderr := &sessionWriter{s: s, kind: "stdout"}, &sessionWriter{s: s, kind: "stderr"}
+	s.cmd = &exec.Cmd{
+		Path:   args[0],
+		Args:   append(args[:len(args):len(args)], "-c", sessionLoop),
+		Env:    Environ(),
+		Stdout: stdout,
+		Stderr: stderr,
+		// The shell's file descriptor 3.
+		ExtraFiles: []*os.File{r},
+		// Assign a process group ID that all child processes will belong to.
+		SysProcAttr: &syscall.SysProcAttr{Setpgid: true},
+	}
+	fail := func(err error) (*session, error) {
+		if s.cleanup != nil {
+			s.cleanup()
+		}
+		w.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	stdin, err := s.cmd.StdinPipe()
+	if err != nil {
+		return fail(err)
+	}
+	s.stdin = &sessionInput{s: s, w: stdin}
+	if cfg := pol.SandboxFor(string(shell)); cfg != nil {
+		if s.cleanup, err = sandbox.Command(s.cmd, cfg, dir); err != nil {
+			return fail(err)
+		}
+		s.sandbox = true
+	}
+	if err := s.cmd.Start(); err != nil {
+		return fail(err)
+	}
+
+	go func() {
+		err := s.cmd.Wait()
+		// The shell exited during a run, eg: the snippet called exit, so
+		// what was held back as the possible start of a marker is output.
+		stdout.flush()
+		stderr.flush()
+		if s.cleanup != nil {
+			s.cleanup()
+		}
+		w.Close()
+		os.RemoveAll(dir)
+		s.mu.Lock()
+		s.ended = true
+		p := s.cur
+		s.cur = nil
+		s.mu.Unlock()
+		close(s.exited)
+		if p != nil {
+			p.result <- err
+		}
+	}()
+	return s, nil
+}
+
+// usable reports whether the session can run further snippets with the
+// given shebang.
+func (s *session) usable(args []string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended || len(args) != len(s.args) {
+		return false
+	}
+	for i := range args {
+		if args[i] != s.args[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// cwd returns the working directory of the shell after its last run, for
+// runs with the same Id outside the session. Sandboxed sessions report ""
+// as their directories may only exist within the sandbox.
+func (s *session) cwd() string {
+	if s == nil || s.sandbox {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.wd
+}
+
+// close kills the shell and waits for it to exit.
+func (s *session) close() {
+	if s == nil {
+		return
+	}
+	syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL)
+	<-s.exited
+}
+
+// start runs body in the session as process p. The run ends when the shell
+// prints the markers, or exits.
+func (s *session) start(p *process, body string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return errSessionEnded
+	}
+	s.n++
+	script := filepath.Join(s.dir, fmt.Sprintf("run-%d", s.n))
+	if err := ioutil.WriteFile(script, []byte(body), 0600); err != nil {
+		return err
+	}
+
+	p.path = script // to be removed by p.end
+	p.run = s.cmd
+	p.sessionRun = true
+	p.result = make(chan error, 1)
+
+	// Source the script, so that it runs in the shell itself, then report
+	// its exit status and the working directory on both outputs.
+	line := fmt.Sprintf(". %s; __present_status=$?; printf '\\n%s%%d:%%s\\n' $__present_status \"$PWD\"; printf '\\n%[2]s%%d:%%s\\n' $__present_status \"$PWD\" >&2\n",
+		quote(script), s.marker[1:])
+	if _, err := io.WriteString(s.cmds, line); err != nil {
+		return err
+	}
+	s.cur, s.seen, s.status = p, 0, ""
+
+	// "stdin" messages go to the shell's standard input; closing it ends
+	// the session once the run completes.
+	p.input = make(chan string, stdinBuffer)
+	go copyInput(s.stdin, p.input, p.done)
+	return nil
+}
+
+// markerSeen records a marker with the given exit status and working
+// directory, ending the run once it has been seen on both stdout and stderr.
+func (s *session) markerSeen(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur == nil {
+		return
+	}
+	s.status = status
+	if i := strings.IndexByte(status, ':'); i >= 0 {
+		s.status, s.wd = status[:i], status[i+1:]
+	}
+	if s.seen++; s.seen < 2 {
+		return
+	}
+	var err error
+	if code, _ := strconv.Atoi(s.status); code != 0 {
+		err = statusError(code)
+	}
+	s.cur.result <- err
+	s.cur = nil
+}
+
+// emit sends output to the current run, if any. Output while no snippet is
+// running, eg: from a background job, is dropped.
+func (s *session) emit(kind string, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	// Hold the lock so the run can't end, closing p.out, while sending.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur != nil {
+		s.cur.out <- &Message{Kind: kind, Body: safeString(b)}
+	}
+}
+
+// sessionInput is the standard input of a session. Closing it marks the
+// session as ended, so that later runs start a new one with open input.
+type sessionInput struct {
+	s *session
+	w io.WriteCloser
+}
+
+func (in *sessionInput) Write(b []byte) (int, error) {
+	return in.w.Write(b)
+}
+
+func (in *sessionInput) Close() error {
+	in.s.mu.Lock()
+	in.s.ended = true
+	in.s.mu.Unlock()
+	return in.w.Close()
+}
+
+// sessionWriter routes the output of a session to its current run,
+// watching for the marker ending the run.
+type sessionWriter struct {
+	s    *session
+	kind string
+	buf  []byte
+}
+
+func (w *sessionWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	// The marker is printed with a newline before it, in case the output
+	// doesn't end with one. Look for the rest of it, in case a read split
+	// them.
+	marker := w.s.marker
+	token := marker[1:]
+	for {
+		i := bytes.Index(w.buf, token)
+		if i < 0 {
+			break
+		}
+		out := bytes.TrimSuffix(w.buf[:i], []byte("\n"))
+		j := bytes.IndexByte(w.buf[i+len(token):], '\n')
+		if j < 0 {
+			// Wait for the rest of the marker line.
+			w.emit(out)
+			w.buf = append(w.buf[:0], w.buf[i:]...)
+			return len(b), nil
+		}
+		w.emit(out)
+		status := string(w.buf[i+len(token) : i+len(token)+j])
+		w.buf = append(w.buf[:0], w.buf[i+len(token)+j+1:]...)
+		w.s.markerSeen(status)
+	}
+	// Hold back what may be the start of a marker. A lone newline is
+	// output, as the marker is printed in a single write so would follow
+	// it.
+	n := partialSuffix(w.buf, marker)
+	if n == 1 {
+		n = 0
+	}
+	if m := partialSuffix(w.buf, token); m > n {
+		n = m
+	}
+	n = len(w.buf) - n
+	w.emit(w.buf[:n])
+	w.buf = append(w.buf[:0], w.buf[n:]...)
+	return len(b), nil
+}
+
+// flush emits the output held back once no more is written.
+func (w *sessionWriter) flush() {
+	w.emit(w.buf)
+	w.buf = w.buf[:0]
+}
+
+func (w *sessionWriter) emit(b []byte) {
+	w.s.emit(w.kind, b)
+}
+
+// partialSuffix returns the length of the longest suffix of b which is a
+// proper prefix of token.
+func partialSuffix(b, token []byte) int {
+	n := len(token) - 1
+	if n > len(b) {
+		n = len(b)
+	}
+	for ; n > 0; n-- {
+		if bytes.HasSuffix(b, token[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// quote quotes s for the shell.
+func quote(s string) string {
+	return "'" + string(bytes.ReplaceAll([]byte(s), []byte("'"), []byte(`'\''`))) + "'"
+}
+
+// startSessionProcess runs a shell snippet in the session for id, starting
+// one if there is none or the shebang has changed, and sends its output
+// and end event as Messages on the provided channel.
+func startSessionProcess(sessions map[string]*session, id, body string, dest chan<- *Message, opt *Options, pol *policy.Policy) *process {
+	p := newProcess(id, shell, dest, opt, pol)
+	_, args := shebang(body)
+	s := sessions[id]
+	if s == nil || !s.usable(args) {
+		s.close()
+		delete(sessions, id)
+		var err error
+		if s, err = startSession(args, pol); err != nil {
+			p.end(err)
+			return nil
+		}
+		sessions[id] = s
+	}
+	if err := s.start(p, body); err != nil {
+		p.end(err)
+		return nil
+	}
+	p.wait(opt)
+	return p
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestSession(t *testing.T) {
+	dial, cleanup := newTestServer(t)
+	defer cleanup()
+	ws, err := dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		kind    string
+		body    string
+		wantOut string
+		wantEnd string
+	}{
+		{"Change directory", "run", "#!/bin/sh\ncd " + dir + "\necho ok", "ok\n", ""},
+		{"Directory persists", "run", "#!/bin/sh\npwd", dir + "\n", ""},
+		{"Export variable", "run", "#!/bin/sh\nexport GREETING=hello", "", ""},
+		{"Define function", "run", "#!/bin/sh\ngreet() { echo \"$GREETING $1\"; }", "", ""},
+		{"Use both", "run", "#!/bin/sh\ngreet gopher", "hello gopher\n", ""},
+		{"Exit code", "run", "#!/bin/sh\nfalse", "", "exit status 1"},
+		{"Output without newline", "run", "#!/bin/sh\nprintf abc", "abc", ""},
+		{"Still in session", "run", "#!/bin/sh\necho $GREETING", "hello\n", ""},
+		{"Reset", "resetSession", "", "", ""},
+		{"Fresh session", "run", "#!/bin/sh\necho \"[$GREETING]\"; pwd", "[]\n" + wd + "\n", ""},
+		{"Exit ends session", "run", "#!/bin/sh\nexport GREETING=hi\nexit 3", "", "exit status 3"},
+		{"New session after exit", "run", "#!/bin/sh\necho \"[$GREETING]\"", "[]\n", ""},
+		{"Output before exit", "run", "#!/bin/sh\necho bye\nexit 2", "bye\n", "exit status 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			websocket.JSON.Send(ws, &Message{Id: "shell", Kind: tt.kind, Body: tt.body})
+			if tt.kind != "run" {
+				return
+			}
+			out, end := receiveUntilEnd(t, ws, "shell")
+			if out != tt.wantOut || end.Body != tt.wantEnd {
+				t.Errorf("got stdout %q, end %q, want %q, %q", out, end.Body, tt.wantOut, tt.wantEnd)
+			}
+		})
+	}
+
+	// The server's working directory is never changed.
+	if got, _ := os.Getwd(); got != wd {
+		t.Errorf("server working directory changed to %q", got)
+	}
+}
+
+func TestSessionCPULimit(t *testing.T) {
+	dial, cleanup := newTestServer(t)
+	defer cleanup()
+	ws, err := dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	// The session's shell is never given the CPU limit of a run, which
+	// would carry over to later runs.
+	var limits []string
+	for _, opt := range []*Options{nil, {CPUTimeout: "5s"}, nil} {
+		websocket.JSON.Send(ws, &Message{Id: "shell", Kind: "run", Body: "#!/bin/sh\nulimit -t", Options: opt})
+		out, end := receiveUntilEnd(t, ws, "shell")
+		if end.Body != "" {
+			t.Fatalf("got end %q", end.Body)
+		}
+		limits = append(limits, out)
+	}
+	if limits[2] != limits[0] {
+		t.Errorf("got CPU limit %q after a limited run, want %q", limits[2], limits[0])
+	}
+}
+
+func TestSessionKill(t *testing.T) {
+	dial, cleanup := newTestServer(t)
+	defer cleanup()
+	ws, err := dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	websocket.JSON.Send(ws, &Message{Id: "shell", Kind: "run", Body: "#!/bin/sh\nexport GREETING=hello"})
+	receiveUntilEnd(t, ws, "shell")
+	websocket.JSON.Send(ws, &Message{Id: "shell", Kind: "run", Body: "#!/bin/sh\nsleep 10"})
+	websocket.JSON.Send(ws, &Message{Id: "shell", Kind: "kill"})
+	if _, end := receiveUntilEnd(t, ws, "shell"); end.Body != "signal: killed" || end.Exit.KilledBy != "user" {
+		t.Errorf("kill: got end %q, killed by %q", end.Body, end.Exit.KilledBy)
+	}
+
+	// Killing a run ends its session.
+	websocket.JSON.Send(ws, &Message{Id: "shell", Kind: "run", Body: "#!/bin/sh\necho \"[$GREETING]\""})
+	if out, end := receiveUntilEnd(t, ws, "shell"); out != "[]\n" || end.Body != "" {
+		t.Errorf("after kill: got stdout %q, end %q", out, end.Body)
+	}
+}
+
+func TestSessionWriter(t *testing.T) {
+	out := make(chan *Message, 10)
+	s := &session{marker: []byte("\n__present_x:")}
+	s.cur = &process{out: out, result: make(chan error, 1)}
+	w := &sessionWriter{s: s, kind: "stdout"}
+
+	// A marker split across writes is still found. Output after it still
+	// belongs to the run until the marker on stderr is seen.
+	for _, b := range []string{"hello\n", "\n__pre", "sent_x:", "0:/tmp\nafter"} {
+		w.Write([]byte(b))
+	}
+	var got string
+	for len(out) > 0 {
+		got += (<-out).Body
+	}
+	if want := "hello\nafter"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+	if s.seen != 1 || s.status != "0" || s.wd != "/tmp" {
+		t.Errorf("got %d markers with status %q in %q, want 1 with status 0 in /tmp", s.seen, s.status, s.wd)
+	}
+}
+
+func TestSessionConcurrentDirs(t *testing.T) {
+	dial, cleanup := newTestServer(t)
+	defer cleanup()
+	wd, _ := os.Getwd()
+
+	// Each client changes directory in its own session, concurrently.
+	t.Run("clients", func(t *testing.T) {
+		for _, name := range []string{"a", "b"} {
+			t.Run(name, func(t *testing.T) {
+				t.Parallel()
+				dir := t.TempDir()
+				ws, err := dial("token=" + testToken)
+				if err != nil {
+					t.Fatalf("dial: %v", err)
+				}
+				defer ws.Close()
+
+				websocket.JSON.Send(ws, &Message{Id: "shell", Kind: "run", Body: "#!/bin/sh\ncd " + dir})
+				receiveUntilEnd(t, ws, "shell")
+				for i := 0; i < 5; i++ {
+					websocket.JSON.Send(ws, &Message{Id: "shell", Kind: "run", Body: "#!/bin/sh\npwd"})
+					if out, _ := receiveUntilEnd(t, ws, "shell"); out != dir+"\n" {
+						t.Errorf("session: got cwd %q, want %q", out, dir)
+					}
+				}
+				// Runs outside the session, here in a terminal, start in
+				// the session's directory.
+				websocket.JSON.Send(ws, &Message{Id: "shell", Kind: "run", Body: "#!/bin/sh\npwd", Options: &Options{PTY: true}})
+				if out, _ := receiveUntilEnd(t, ws, "shell"); out != dir+"\r\n" {
+					t.Errorf("pty: got cwd %q, want %q", out, dir)
+				}
+			})
+		}
+	})
+
+	if got, _ := os.Getwd(); got != wd {
+		t.Errorf("server working directory changed to %q", got)
+	}
+}
@@ -16,8 +16,10 @@ package socket // import "golang.org/x/tools/playground/socket"
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"go/parser"
 	"go/token"
 	"io"
@@ -27,14 +29,17 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unicode/utf8"
 
 	exec "golang.org/x/sys/execabs"
 
+	"github.com/rquitales/go-presentation-server/pkg/k8s"
+	"github.com/rquitales/go-presentation-server/pkg/policy"
+	"github.com/rquitales/go-presentation-server/pkg/sandbox"
 	"golang.org/x/net/websocket"
 	"golang.org/x/tools/txtar"
 )
@@ -56,61 +61,188 @@ const (
 // distinguished by the Kind field.
 type Message struct {
 	Id      string // client-provided unique id for the process
-	Kind    string // in: "run", "kill" out: "stdout", "stderr", "end"
+	Kind    string // in: "run", "test", "check", "format", "kill", "stdin", "eof", "resize", "resetSession", "resume", "watch", "logs" out: "stdout", "stderr", "testResult", "benchmark", "diagnostic", "formatted", "resumed", "kubectlResult", "kubectlStatus", "watchEvent", "log", "end"
 	Body    string
 	Options *Options `json:",omitempty"`
 	Path    string   //if saving a file
+	Exit    *Exit    `json:",omitempty"` // how the process ended (for "end" only)
+	// Seq numbers the messages sent for a process, from 1, so that clients
+	// can order and dedupe them, and resume after the last one received,
+	// given in "resume" messages. Replies to "resume" messages are not
+	// numbered, as they are not output of the process.
+	Seq uint64 `json:",omitempty"`
+	// Time is when the server received the output, in milliseconds since
+	// the Unix epoch. Coalesced output has the time of its first part.
+	Time int64 `json:",omitempty"`
+
+	Test       *TestResult      `json:",omitempty"` // for "testResult" only
+	Benchmark  *BenchmarkResult `json:",omitempty"` // for "benchmark" only
+	Diagnostic *Diagnostic      `json:",omitempty"` // for "diagnostic" only
+	Object     *k8s.Result      `json:",omitempty"` // for "kubectlResult" only
+	Status     *k8s.Status      `json:",omitempty"` // for "kubectlStatus" only
+	Event      *k8s.Event       `json:",omitempty"` // for "watchEvent" only
+	Log        *k8s.LogLine     `json:",omitempty"` // for "log" only
+
+	tty bool // output of a terminal, not counted by the limiter
+}
+
+// structured reports whether the message carries more than its Body, so
+// must not be coalesced with others.
+func (m *Message) structured() bool {
+	return m.Test != nil || m.Benchmark != nil || m.Diagnostic != nil || m.Object != nil || m.Status != nil || m.Event != nil || m.Log != nil
 }
 
 // Options specify additional message options.
 type Options struct {
-	Race bool // use -race flag when building code (for "run" only)
+	Race       bool   // use -race flag when building code (for "run" and "test")
+	Timeout    string `json:",omitempty"` // shortens the wall-clock timeout, eg: "2m"
+	CPUTimeout string `json:",omitempty"` // shortens the CPU time limit, eg: "10s" (not for shell sessions)
+	PTY        bool   `json:",omitempty"` // run shebang programs in a terminal (for "run" only)
+	Rows       uint16 `json:",omitempty"` // terminal size (for "run" with PTY, and "resize")
+	Cols       uint16 `json:",omitempty"`
+	Run        string `json:",omitempty"` // only run tests matching this regexp (for "test" only)
+	Bench      string `json:",omitempty"` // run benchmarks matching this regexp (for "test" only)
+	Imports    bool   `json:",omitempty"` // add missing and remove unused imports (for "format" only)
+	GOOS       string `json:",omitempty"` // build for another platform, eg: "js", for download instead of running (for "run" only)
+	GOARCH     string `json:",omitempty"` // eg: "wasm"
+	Wait       string `json:",omitempty"` // wait up to this long for applied objects to become ready, eg: "2m" (for "kubectlApply" only)
+	APIVersion string `json:",omitempty"` // of the Kubernetes objects to watch, eg: "apps/v1" (for "watch" only)
+	Kind       string `json:",omitempty"` // eg: "Deployment"
+	Namespace  string `json:",omitempty"` // the kubeconfig's namespace if empty (for "watch" and "logs")
+	Selector   string `json:",omitempty"` // label selector, eg: "app=web"
 }
 
 type runKind string
 
 const (
-	shell   runKind = "shell"
-	golang  runKind = "go"
-	kubectl runKind = "kubectl"
+	shell     runKind = "shell"
+	golang    runKind = "go"
+	kubectl   runKind = "kubectl"
+	terraform runKind = "terraform"
+	stream    runKind = "stream" // Kubernetes watches and logs, which run until killed
 )
 
+// Config configures the websocket handler returned by NewHandler.
+type Config struct {
+	// Origin is the address the presentation is served from.
+	Origin *url.URL
+	// AllowedOrigins are additional origin patterns permitted to connect.
+	AllowedOrigins []string
+	// Token is the presenter token required to start processes.
+	Token string
+	// Policy restricts what presenters may run. A nil Policy allows
+	// everything.
+	Policy *policy.Policy
+	// Go configures how Go snippets are built.
+	Go GoBuild
+	// Recordings, if set, records the output of every process, or replays
+	// it instead of running anything.
+	Recordings *Recordings
+	// Transcripts, if set, keeps a transcript of every presenter
+	// connection.
+	Transcripts *Transcripts
+	// ResumeGrace is how long the processes of a presenter connection which
+	// dropped keep running, waiting for a "resume" message from a new
+	// connection. If zero, they are killed straight away.
+	ResumeGrace time.Duration
+	// Kubernetes applies, creates and deletes the manifests of kubectl
+	// messages. If nil, they fail.
+	Kubernetes *k8s.Client
+}
+
+// handler serves websocket connections for a present server.
+type handler struct {
+	origins *originChecker
+	token   string
+	policy  *policy.Policy
+	hub     *hub
+	goBuild *goBuilder
+	rec     *Recordings
+	trans   *Transcripts
+	grace   time.Duration
+	kube    *k8s.Client
+
+	mu       sync.Mutex
+	detached map[detachKey]*detached
+}
+
 // NewHandler returns a websocket server which checks the origin of requests.
-func NewHandler(origin *url.URL) websocket.Server {
+// Connections are accepted from the address the server is served from, and
+// from any origin matching one of the allowed patterns. Connections must
+// also either authenticate as presenter or ask for the read-only audience
+// role.
+func NewHandler(cfg Config) (websocket.Server, error) {
+	if cfg.Token == "" {
+		return websocket.Server{}, errors.New("presenter token cannot be empty")
+	}
+	oc, err := newOriginChecker(cfg.Origin, cfg.AllowedOrigins)
+	if err != nil {
+		return websocket.Server{}, err
+	}
+	gb, err := newGoBuilder(cfg.Go)
+	if err != nil {
+		return websocket.Server{}, err
+	}
+	h := &handler{origins: oc, token: cfg.Token, policy: cfg.Policy, hub: newHub(), goBuild: gb, rec: cfg.Recordings, trans: cfg.Transcripts, grace: cfg.ResumeGrace, kube: cfg.Kubernetes, detached: make(map[detachKey]*detached)}
 	return websocket.Server{
-		Config:    websocket.Config{Origin: origin},
-		Handshake: handshake,
-		Handler:   websocket.Handler(socketHandler),
-	}
-}
-
-// handshake checks the origin of a request during the websocket handshake.
-func handshake(c *websocket.Config, req *http.Request) error {
-	// o, err := websocket.Origin(c, req)
-	// if err != nil {
-	// 	log.Println("bad websocket origin:", err)
-	// 	return websocket.ErrBadWebSocketOrigin
-	// }
-	// _, port, err := net.SplitHostPort(c.Origin.Host)
-	// if err != nil {
-	// 	log.Println("bad websocket origin:", err)
-	// 	return websocket.ErrBadWebSocketOrigin
-	// }
-	// ok := c.Origin.Scheme == o.Scheme && (c.Origin.Host == o.Host || c.Origin.Host == net.JoinHostPort(o.Host, port) || strings.Contains(o.Host, "localhost") || strings.Contains(o.Host, "rquitales"))
-	// if !ok {
-	// 	log.Println("bad websocket origin:", o)
-	// 	return websocket.ErrBadWebSocketOrigin
-	// }
-	log.Println("accepting connection from:", req.RemoteAddr)
+		Config:    websocket.Config{Origin: cfg.Origin},
+		Handshake: h.handshake,
+		Handler:   websocket.Handler(h.socketHandler),
+	}, nil
+}
+
+// handshake checks the origin and credentials of a request during the
+// websocket handshake.
+func (h *handler) handshake(c *websocket.Config, req *http.Request) error {
+	if err := checkOrigin(h.origins, c, req); err != nil {
+		return err
+	}
+	r, err := authenticate(h.token, req)
+	if err != nil {
+		log.Printf("rejecting connection from %s: %v", req.RemoteAddr, err)
+		return err
+	}
+	if session := req.URL.Query().Get(SessionParam); session != "" {
+		log.Printf("accepting %s connection to session %q from: %s", r, session, req.RemoteAddr)
+		return nil
+	}
+	log.Printf("accepting %s connection from: %s", r, req.RemoteAddr)
+	return nil
+}
+
+// checkOrigin checks the origin of a request during the websocket handshake.
+func checkOrigin(oc *originChecker, c *websocket.Config, req *http.Request) error {
+	o, err := websocket.Origin(c, req)
+	if err != nil {
+		log.Printf("rejecting connection from %s: bad websocket origin: %v", req.RemoteAddr, err)
+		return websocket.ErrBadWebSocketOrigin
+	}
+	if err := oc.check(o); err != nil {
+		log.Printf("rejecting connection from %s: %v", req.RemoteAddr, err)
+		return websocket.ErrBadWebSocketOrigin
+	}
 	return nil
 }
 
 // socketHandler handles the websocket connection for a given present session.
 // It handles transcoding Messages to and from JSON format, and starting
 // and killing processes.
-func socketHandler(c *websocket.Conn) {
+func (h *handler) socketHandler(c *websocket.Conn) {
+	r, err := authenticate(h.token, c.Request())
+	if err != nil {
+		// Already checked during the handshake.
+		return
+	}
+	sessionName := c.Request().URL.Query().Get(SessionParam)
+
 	in, out := make(chan *Message), make(chan *Message)
-	errc := make(chan error, 1)
+	var tr *transcript
+	if r == audience {
+		out = make(chan *Message, audienceBuffer)
+	} else {
+		tr = h.trans.start(c.Request().RemoteAddr)
+	}
+	errc := make(chan error, 2)
 
 	// Decode messages from client and send to the in channel.
 	go func() {
@@ -126,66 +258,201 @@ func socketHandler(c *websocket.Conn) {
 	}()
 
 	// Receive messages from the out channel and encode to the client.
+	// Presenter output is also broadcast to the audience. Once encoding
+	// fails, keep draining so that senders never block.
 	go func() {
 		enc := json.NewEncoder(c)
 		for m := range out {
 			if err := enc.Encode(m); err != nil {
 				errc <- err
-				return
+				break
+			}
+			if r == presenter {
+				h.hub.publish(sessionName, m)
+				tr.add(m, false)
 			}
 		}
+		for range out {
+		}
 	}()
 	defer close(out)
 
+	if r == audience {
+		h.hub.subscribe(sessionName, out)
+		defer h.hub.unsubscribe(sessionName, out)
+		for {
+			select {
+			case m := <-in:
+				if m.Kind != "kill" {
+					out <- failed(m.Id, errReadOnly)
+				}
+			case err := <-errc:
+				if err != io.EOF {
+					log.Println(err)
+				}
+				return
+			}
+		}
+	}
+
 	// Start and kill processes and handle errors.
 	proc := make(map[string]*process)
+	sessions := make(map[string]*session)
+	replays := make(map[string]*replay)
+	relays := make(map[string]*relay)
 	for {
 		select {
 		case m := <-in:
+			if err := checkPolicy(h.policy, m, h.kube.Namespace()); err != nil {
+				log.Printf("denied %s from %s: %v", m.Kind, c.Request().RemoteAddr, err)
+				out <- failed(m.Id, err)
+				continue
+			}
+			if err := m.Options.validate(); err != nil {
+				out <- failed(m.Id, err)
+				continue
+			}
+			tr.add(m, true)
+			if h.rec.replaying() && !controlKind(m.Kind) {
+				log.Printf("replaying %s from: %s", m.Kind, c.Request().RemoteAddr)
+				replays[m.Id].Kill()
+				replays[m.Id] = h.rec.startReplay(m, out)
+				continue
+			}
+			var dest chan<- *Message = out
+			var rl *relay
+			if !controlKind(m.Kind) {
+				rl = newRelay(m.Id, out)
+				dest = h.rec.tee(m, rl.in)
+			}
 			switch m.Kind {
 			case "run":
 				log.Println("running code snippet from:", c.Request().RemoteAddr)
 				proc[m.Id].Kill()
-				var wd string
-				if p, ok := proc[m.Id]; ok {
-					wd = p.wd
+				if path, args := shebang(m.Body); isShell(path, args) && (m.Options == nil || !m.Options.PTY) {
+					proc[m.Id] = startSessionProcess(sessions, m.Id, m.Body, dest, m.Options, h.policy)
+					break
 				}
-				proc[m.Id] = startProcess(m.Id, m.Body, out, m.Options, wd)
+				proc[m.Id] = startProcess(m.Id, m.Body, dest, m.Options, sessions[m.Id].cwd(), h.policy, h.goBuild)
+			case "test":
+				log.Println("running tests from:", c.Request().RemoteAddr)
+				proc[m.Id].Kill()
+				proc[m.Id] = startTest(m.Id, m.Body, dest, m.Options, h.policy, h.goBuild)
+			case "check":
+				proc[m.Id].Kill()
+				proc[m.Id] = startCheck(m.Id, m.Body, dest, m.Options, h.policy, h.goBuild)
+			case "format":
+				proc[m.Id].Kill()
+				proc[m.Id] = startFormat(m.Id, m.Body, dest, m.Options, h.policy)
+			case "resetSession":
+				proc[m.Id].Kill()
+				sessions[m.Id].close()
+				delete(sessions, m.Id)
 			case "saveFile":
 				proc[m.Id].Kill()
-				proc[m.Id] = startSaveFile(m.Id, m.Path, m.Body, out, m.Options)
+				proc[m.Id] = startSaveFile(m.Id, m.Path, m.Body, dest, m.Options, h.policy)
 			case "kubectlApply":
 				log.Println("running kubectl apply from:", c.Request().RemoteAddr)
 				proc[m.Id].Kill()
-				proc[m.Id] = startKubectl(m.Id, "apply", m.Body, out, m.Options)
+				proc[m.Id] = startKubectl(m.Id, "apply", m.Body, dest, m.Options, h.policy, h.kube)
 			case "kubectlCreate":
 				log.Println("running kubectl create from:", c.Request().RemoteAddr)
 				proc[m.Id].Kill()
-				proc[m.Id] = startKubectl(m.Id, "create", m.Body, out, m.Options)
+				proc[m.Id] = startKubectl(m.Id, "create", m.Body, dest, m.Options, h.policy, h.kube)
 			case "kubectlDelete":
 				log.Println("running kubectl delete from:", c.Request().RemoteAddr)
 				proc[m.Id].Kill()
-				proc[m.Id] = startKubectl(m.Id, "delete", m.Body, out, m.Options)
+				proc[m.Id] = startKubectl(m.Id, "delete", m.Body, dest, m.Options, h.policy, h.kube)
+			case "kubectlDryRun":
+				log.Println("running kubectl dry run from:", c.Request().RemoteAddr)
+				proc[m.Id].Kill()
+				proc[m.Id] = startKubectl(m.Id, "dryRun", m.Body, dest, m.Options, h.policy, h.kube)
+			case "kubectlDiff":
+				log.Println("running kubectl diff from:", c.Request().RemoteAddr)
+				proc[m.Id].Kill()
+				proc[m.Id] = startKubectl(m.Id, "diff", m.Body, dest, m.Options, h.policy, h.kube)
 			case "terraformApply":
 				log.Println("running terraform apply from:", c.Request().RemoteAddr)
 				proc[m.Id].Kill()
-				proc[m.Id] = startTerraform(m.Id, "apply", m.Body, out, m.Options)
+				proc[m.Id] = startTerraform(m.Id, "apply", m.Body, dest, m.Options, h.policy)
 			case "terraformDestroy":
 				log.Println("running terraform destroy from:", c.Request().RemoteAddr)
 				proc[m.Id].Kill()
-				proc[m.Id] = startTerraform(m.Id, "destroy", m.Body, out, m.Options)
+				proc[m.Id] = startTerraform(m.Id, "destroy", m.Body, dest, m.Options, h.policy)
+			case "watch":
+				log.Println("watching Kubernetes objects from:", c.Request().RemoteAddr)
+				proc[m.Id].Kill()
+				proc[m.Id] = startWatch(m.Id, dest, m.Options, h.policy, h.kube)
+			case "logs":
+				log.Println("following Kubernetes logs from:", c.Request().RemoteAddr)
+				proc[m.Id].Kill()
+				proc[m.Id] = startLogs(m.Id, dest, m.Options, h.policy, h.kube)
+			case "stdin":
+				if err := proc[m.Id].write(m.Body); err != nil {
+					log.Printf("dropped stdin of %s from %s: %v", m.Id, c.Request().RemoteAddr, err)
+				}
+			case "eof":
+				proc[m.Id].closeStdin()
+			case "resize":
+				proc[m.Id].resize(m.Options)
 			case "kill":
 				proc[m.Id].Kill()
+				replays[m.Id].Kill()
+			case "resume":
+				d := h.resume(sessionName, m.Id)
+				if d == nil {
+					end := failed(m.Id, errNothingToResume)
+					end.Seq = 0
+					out <- end
+					break
+				}
+				log.Println("resuming", m.Id, "from:", c.Request().RemoteAddr)
+				// Any process this connection runs under the Id is replaced,
+				// without its end being taken for that of the one resumed.
+				relays[m.Id].detach()
+				proc[m.Id].Kill()
+				proc[m.Id], relays[m.Id] = d.proc, d.relay
+				if d.session != nil {
+					sessions[m.Id].close()
+					sessions[m.Id] = d.session
+				}
+				d.relay.attach(out, m.Seq)
+			default:
+				if rl != nil {
+					// Nothing was started to relay or record.
+					if dest != rl.in {
+						close(dest)
+					}
+					close(rl.in)
+				}
+				continue
+			}
+			if rl != nil {
+				relays[m.Id] = rl
 			}
 		case err := <-errc:
 			if err != io.EOF {
 				// A encode or decode has failed; bail.
 				log.Println(err)
 			}
+			for _, r := range replays {
+				r.Kill()
+			}
+			if h.grace > 0 {
+				// Keep processes running for a new connection to resume.
+				h.detach(sessionName, relays, proc, sessions)
+				return
+			}
 			// Shut down any running processes.
 			for _, p := range proc {
 				p.Kill()
 			}
+			for _, s := range sessions {
+				s.close()
+			}
+			for _, r := range relays {
+				r.detach()
+			}
 			return
 		}
 	}
@@ -193,53 +460,160 @@ func socketHandler(c *websocket.Conn) {
 
 // process represents a running process.
 type process struct {
-	out  chan<- *Message
-	done chan struct{} // closed when wait completes
-	run  *exec.Cmd
-	path string
-	kind runKind
-	wd   string
-}
-
-// startProcess builds and runs the given program, sending its output
-// and end event as Messages on the provided channel.
-func startProcess(id, body string, dest chan<- *Message, opt *Options, wd string) *process {
-	var (
-		done = make(chan struct{})
-		out  = make(chan *Message)
-		p    = &process{out: out, done: done, wd: wd}
-	)
+	out        chan<- *Message
+	done       chan struct{} // closed when wait completes
+	run        *exec.Cmd
+	path       string
+	kind       runKind
+	wd         string          // working directory, or "" for the server's
+	policy     *policy.Policy  // configures sandboxing and timeouts
+	cleanup    func()          // releases the sandbox, if any
+	input      chan string     // queued "stdin" messages, if reading stdin
+	goBuild    *goBuilder      // builds Go snippets, if any
+	target     target          // platform Go snippets are built for
+	tty        *os.File        // the terminal, if running in one
+	ttyDone    chan struct{}   // closed once all terminal output is sent
+	result     chan error      // receives the result of a session run, or of one in the server
+	sessionRun bool            // run is the shell of a session, shared with other runs
+	ctx        context.Context // done once the process is killed, stopping its build or run
+	cancel     func()          // kills the process, by canceling ctx
+	started    time.Time
+	phase      string // what is running, reported in the end message
+
+	diagnosed map[string]bool // diagnostics sent, used by the build only
+	size      int64           // of the built Go binary, if any
+	artifact  string          // URL path of a binary built for another platform
+
+	mu       sync.Mutex
+	timer    *time.Timer   // kills the process on timeout
+	cpu      time.Duration // CPU time limit, if any
+	killed   string        // why the process was killed, if it was
+	killedBy string        // who killed the process, if anyone did
+}
+
+// failed returns the "end" message of a process with the given id which
+// could not be started.
+func failed(id string, err error) *Message {
+	return &Message{Id: id, Kind: "end", Body: err.Error(), Seq: 1, Time: millis(time.Now())}
+}
+
+// newProcess returns a process of the given run kind whose output is
+// limited, buffered and sent as Messages with the given id on dest. Its
+// wall-clock timeout starts now, so that it includes any build.
+func newProcess(id string, kind runKind, dest chan<- *Message, opt *Options, pol *policy.Policy) *process {
+	out := make(chan *Message)
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &process{out: out, done: make(chan struct{}), kind: kind, policy: pol, ctx: ctx, cancel: cancel, started: time.Now(), phase: phaseRun}
+	p.limit(opt)
+	byLimiter := killerFunc(func() { p.killFor(killedByLimiter, "") })
 	go func() {
-		defer close(done)
-		for m := range buffer(limiter(out, p), time.After) {
-			m.Id = id
+		defer close(p.done)
+		var seq uint64
+		for m := range buffer(limiter(out, byLimiter), time.After) {
+			seq++
+			m.Id, m.Seq = id, seq
 			dest <- m
 		}
 	}()
-	var err error
-	if path, args := shebang(body); path != "" {
-		err = p.startProcess(path, args, body)
-	} else {
-		err = p.start(body, opt)
+	return p
+}
+
+// startProcess builds and runs the given program in the working directory
+// wd, sending its output and end event as Messages on the provided channel.
+func startProcess(id, body string, dest chan<- *Message, opt *Options, wd string, pol *policy.Policy, gb *goBuilder) *process {
+	path, args := shebang(body)
+	kind := golang
+	if path != "" {
+		kind = shell
 	}
-	if err != nil {
+	p := newProcess(id, kind, dest, opt, pol)
+	p.wd = wd
+	p.goBuild = gb
+	// Input is queued from now, as Go snippets are only run once built.
+	input := make(chan string, stdinBuffer)
+	p.input = input
+	if path == "" {
+		p.background(opt, func() error { return p.start(body, opt, input) })
+		return p
+	}
+	if err := p.startProcess(path, args, body, opt, input); err != nil {
 		p.end(err)
 		return nil
 	}
+	p.wait(opt)
+	return p
+}
+
+// background runs start, which builds and starts the process, in a new
+// goroutine, then waits for the process. Builds can take a while, so they
+// mustn't hold up the socket handler, and are stopped if the process is
+// killed. If start doesn't set the run field, eg: as the snippet was built
+// for another platform, there is nothing to wait for.
+func (p *process) background(opt *Options, start func() error) {
 	go func() {
-		p.end(p.run.Wait())
+		if err := start(); err != nil || p.run == nil {
+			p.end(err)
+			return
+		}
+		p.wait(opt)
+	}()
+}
+
+// wait applies the CPU time limit for the process' run kind, then waits for
+// it to exit in a new goroutine and sends the "end" message. The run is
+// killed if the process is.
+func (p *process) wait(opt *Options) {
+	p.limitCPU(opt)
+	go func() {
+		exited := make(chan struct{})
+		if p.run != nil {
+			go func() {
+				select {
+				case <-p.ctx.Done():
+					p.killRun()
+				case <-exited:
+				}
+			}()
+		}
+		var err error
+		if p.result != nil {
+			err = <-p.result
+		} else {
+			err = p.run.Wait()
+		}
+		close(exited)
+		p.closeTTY()
+		p.end(err)
 	}()
-	return p
 }
 
 // end sends an "end" message to the client, containing the process id and the
-// given error value. It also removes the binary, if present.
+// given error value, or why the process was killed. It also removes the
+// binary, if present.
 func (p *process) end(err error) {
 	if p.path != "" {
 		defer os.RemoveAll(p.path)
 	}
-	m := &Message{Kind: "end"}
-	if err != nil {
+	if p.cleanup != nil {
+		p.cleanup()
+	}
+	by, reason := p.killInfo(err)
+	code, signal := exitStatus(err)
+	if err == nil && p.kind != stream {
+		by = "" // exited before the kill
+	}
+	m := &Message{Kind: "end", Exit: &Exit{
+		Code:     code,
+		Signal:   signal,
+		Phase:    p.phase,
+		Duration: time.Since(p.started).Seconds(),
+		KilledBy: by,
+		Size:     p.size,
+		Artifact: p.artifact,
+	}}
+	if reason != "" {
+		m.Body = "killed: " + reason
+	} else if err != nil {
 		m.Body = err.Error()
 	}
 	p.out <- m
@@ -255,7 +629,8 @@ type killer interface {
 // limiter returns a channel that wraps the given channel.
 // It receives Messages from the given channel and sends them to the returned
 // channel until it passes msgLimit messages, at which point it will kill the
-// process and pass only the "end" message.
+// process and pass only the "end" message. Terminal output isn't counted, as
+// it echoes each keystroke of interactive programs in a message of its own.
 // When the given channel is closed, or when the "end" message is received,
 // it closes the returned channel.
 func limiter(in <-chan *Message, p killer) <-chan *Message {
@@ -265,6 +640,9 @@ func limiter(in <-chan *Message, p killer) <-chan *Message {
 		n := 0
 		for m := range in {
 			switch {
+			case m.tty && n < msgLimit:
+				out <- m
+				continue // don't increment
 			case n < msgLimit || m.Kind == "end":
 				out <- m
 				if m.Kind == "end" {
@@ -289,8 +667,11 @@ func limiter(in <-chan *Message, p killer) <-chan *Message {
 // Message bodies are gathered over the period msgDelay and coalesced into a
 // single Message before they are passed on. Messages of the same kind are
 // coalesced; when a message of a different kind is received, any buffered
-// messages are flushed. When the given channel is closed, buffer flushes the
-// remaining buffered messages and closes the returned channel.
+// messages are flushed. Structured messages are passed on as is. Messages
+// are stamped with the time they are received, unless they already were,
+// and coalesced ones keep the time of the first. When the given channel is
+// closed, buffer flushes the remaining buffered messages and closes the
+// returned channel.
 // The timeAfter func should be time.After. It exists for testing.
 func buffer(in <-chan *Message, timeAfter func(time.Duration) <-chan time.Time) <-chan *Message {
 	out := make(chan *Message)
@@ -300,11 +681,12 @@ func buffer(in <-chan *Message, timeAfter func(time.Duration) <-chan time.Time)
 			tc    <-chan time.Time
 			buf   []byte
 			kind  string
+			at    int64 // time of the first message in buf
 			flush = func() {
 				if len(buf) == 0 {
 					return
 				}
-				out <- &Message{Kind: kind, Body: safeString(buf)}
+				out <- &Message{Kind: kind, Body: safeString(buf), Time: at}
 				buf = buf[:0] // recycle buffer
 				kind = ""
 			}
@@ -316,11 +698,19 @@ func buffer(in <-chan *Message, timeAfter func(time.Duration) <-chan time.Time)
 					flush()
 					return
 				}
+				if m.Time == 0 {
+					m.Time = millis(time.Now())
+				}
 				if m.Kind == "end" {
 					flush()
 					out <- m
 					return
 				}
+				if m.structured() {
+					flush()
+					out <- m
+					continue
+				}
 				if kind != m.Kind {
 					flush()
 					kind = m.Kind
@@ -328,6 +718,9 @@ func buffer(in <-chan *Message, timeAfter func(time.Duration) <-chan time.Time)
 						tc = timeAfter(msgDelay)
 					}
 				}
+				if len(buf) == 0 {
+					at = m.Time
+				}
 				buf = append(buf, m.Body...)
 			case <-tc:
 				flush()
@@ -340,18 +733,40 @@ func buffer(in <-chan *Message, timeAfter func(time.Duration) <-chan time.Time)
 
 // Kill stops the process if it is running and waits for it to exit.
 func (p *process) Kill() {
-	if p == nil || p.run == nil {
+	if p == nil {
 		return
 	}
+	select {
+	case <-p.done:
+		// Already exited. For a session run, p.run is the session's shell,
+		// which must be left running.
+		return
+	default:
+	}
+	p.mu.Lock()
+	if p.killedBy == "" {
+		p.killedBy = killedByUser
+	}
+	p.mu.Unlock()
 
-	if p.kind == shell {
-		// Explicitly kill process group ID if running shell commands.
+	p.cancel()
+	<-p.done // block until process exits
+}
+
+// killRun kills the running command of the process.
+func (p *process) killRun() {
+	if attr := p.run.SysProcAttr; p.kind == shell || (attr != nil && attr.Setpgid) {
+		// Explicitly kill process group ID if running shell commands, or
+		// other commands with children.
 		syscall.Kill(-p.run.Process.Pid, syscall.SIGKILL)
 	} else {
 		p.run.Process.Kill()
 	}
+}
 
-	<-p.done // block until process exits
+// millis returns t in milliseconds since the Unix epoch.
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
 }
 
 // shebang looks for a shebang ('#!') at the beginning of the passed string.
@@ -366,73 +781,68 @@ func shebang(body string) (path string, args []string) {
 		body = body[:i]
 	}
 	fs := strings.Fields(body[2:])
+	if len(fs) == 0 {
+		return "", nil
+	}
 	return fs[0], fs
 }
 
-// startProcess starts a given program given its path and passing the given body
-// to the command standard input.
-func (p *process) startProcess(path string, args []string, body string) error {
-	cmdString := strings.Split(body, "\n")
-	cmdSlice := strings.Split(cmdString[1], " ")
-	log.Println(cmdSlice)
-
-	if len(cmdSlice) > 0 {
-		switch cmdSlice[0] {
-		case "cd":
-			if len(cmdSlice) < 2 {
-				return errors.New("provide path!")
-			}
-
-			homedir, _ := os.UserHomeDir()
-			loc := strings.Replace(cmdSlice[1], "~", homedir, -1)
-			if loc[0] != byte('/') {
-				currDir, _ := os.Getwd()
-				if p.wd != "" {
-					p.wd = filepath.Join(p.wd, loc)
-				} else {
-					p.wd = filepath.Join(currDir, loc)
-				}
-				body = strings.Replace(body, loc, p.wd, -1)
-			} else {
-				p.wd = loc
-			}
-
-		}
+// startProcess starts a given program given its path, passing it the given
+// body as a script file. The process' standard input is left open for
+// "stdin" messages. With the PTY option, the process runs in a terminal.
+func (p *process) startProcess(path string, args []string, body string, opt *Options, input <-chan string) error {
+	// Run the body as a script file, like the kernel does for a shebang,
+	// so that standard input is free for the program itself.
+	dir, err := ioutil.TempDir("", "present-shell-")
+	if err != nil {
+		return err
 	}
-
-	if p.wd != "" {
-		err := os.Chdir(p.wd)
-		if err != nil {
-			return err
-		}
-
+	p.path = dir // to be removed by p.end
+	script := filepath.Join(dir, "script")
+	if err := ioutil.WriteFile(script, []byte(body), 0600); err != nil {
+		return err
 	}
 
 	cmd := &exec.Cmd{
-		Path:   path,
-		Args:   args,
-		Stdin:  strings.NewReader(body),
-		Stdout: &messageWriter{kind: "stdout", out: p.out},
-		Stderr: &messageWriter{kind: "stderr", out: p.out},
+		Path: path,
+		Args: append(args, script),
+		Dir:  p.wd,
 	}
 
-	log.Println("body: ", body)
-
-	// Assign a process group ID that all child processes will belong to.
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-
-	if err := cmd.Start(); err != nil {
-		return err
+	if opt != nil && opt.PTY {
+		// The terminal gets its own session, whose ID is also the
+		// process group ID that all child processes will belong to.
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+		cmd.Env = append(Environ(), "TERM=xterm-256color")
+		if err := p.sandbox(cmd, shell, dir); err != nil {
+			return err
+		}
+		if err := p.startTTY(cmd, opt, input); err != nil {
+			return err
+		}
+	} else {
+		cmd.Stdout = &messageWriter{kind: "stdout", out: p.out}
+		cmd.Stderr = &messageWriter{kind: "stderr", out: p.out}
+		if err := p.openStdin(cmd, input); err != nil {
+			return err
+		}
+		// Assign a process group ID that all child processes will belong to.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if err := p.sandbox(cmd, shell, dir); err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
 	}
 
 	p.run = cmd
-	p.kind = shell
 	return nil
 }
 
 // start builds and starts the given program, sending its output to p.out,
 // and stores the running *exec.Cmd in the run field.
-func (p *process) start(body string, opt *Options) error {
+func (p *process) start(body string, opt *Options, input <-chan string) error {
 	// We "go build" and then exec the binary so that the
 	// resultant *exec.Cmd is a handle to the user's program
 	// (rather than the go tool process).
@@ -444,56 +854,50 @@ func (p *process) start(body string, opt *Options) error {
 	}
 	p.path = path // to be removed by p.end
 
-	out := "prog"
-	if runtime.GOOS == "windows" {
-		out = "prog.exe"
-	}
-	bin := filepath.Join(path, out)
-
-	// write body to x.go files
-	a := txtar.Parse([]byte(body))
-	if len(a.Comment) != 0 {
-		a.Files = append(a.Files, txtar.File{Name: "prog.go", Data: a.Comment})
-		a.Comment = nil
-	}
-	hasModfile := false
-	for _, f := range a.Files {
-		err = ioutil.WriteFile(filepath.Join(path, f.Name), f.Data, 0666)
-		if err != nil {
-			return err
-		}
-		if f.Name == "go.mod" {
-			hasModfile = true
-		}
+	p.target = newTarget(opt)
+	if !p.target.host() && p.goBuild.artifacts() == nil {
+		return fmt.Errorf("building for %s is not enabled", p.target)
 	}
-
-	// build x.go, creating x
-	args := []string{"go", "build", "-tags", "OMIT"}
-	if opt != nil && opt.Race {
+	race := opt != nil && opt.Race
+	args := []string{"build"}
+	if race {
 		p.out <- &Message{
 			Kind: "stderr",
 			Body: "Running with race detector.\n",
 		}
 		args = append(args, "-race")
 	}
-	args = append(args, "-o", bin)
-	cmd := p.cmd(path, args...)
-	if !hasModfile {
-		cmd.Env = append(cmd.Env, "GO111MODULE=off")
-	} else {
-		cmd := p.cmd(path, "go", "mod", "tidy")
-		if err := cmd.Run(); err != nil {
+	// Re-running a snippet reuses the binary built the first time.
+	bin, cached := p.goBuild.cached(body, p.target, args)
+	if !cached {
+		hasModfile, err := writeArchive(path, body, "prog.go")
+		if err != nil {
+			return err
+		}
+		if bin, err = p.build(path, bin, hasModfile, args...); err != nil {
 			return err
 		}
 	}
-	if err := cmd.Run(); err != nil {
+	if fi, err := os.Stat(bin); err == nil {
+		p.size = fi.Size()
+	}
+	if !p.target.host() {
+		// The binary can't run here, so offer it for download instead.
+		p.artifact, err = p.goBuild.artifacts().add(bin)
 		return err
 	}
+	p.phase = phaseRun
 
-	cmd = p.cmd("", bin)
-	if opt != nil && opt.Race {
+	cmd := p.cmd(p.wd, bin)
+	if race {
 		cmd.Env = append(cmd.Env, "GOMAXPROCS=2")
 	}
+	if err := p.openStdin(cmd, input); err != nil {
+		return err
+	}
+	if err := p.sandbox(cmd, golang, filepath.Dir(bin)); err != nil {
+		return err
+	}
 	if err := cmd.Start(); err != nil {
 		// If we failed to exec, that might be because they built
 		// a non-main package instead of an executable.
@@ -504,14 +908,103 @@ func (p *process) start(body string, opt *Options) error {
 		return err
 	}
 	p.run = cmd
-	p.kind = golang
+	return nil
+}
+
+// writeArchive writes the files in the txtar body to dir. A comment at the
+// start of the archive is written to the file name. It reports whether the
+// archive has a go.mod. File names must stay within dir.
+func writeArchive(dir, body, name string) (hasModfile bool, err error) {
+	a := txtar.Parse([]byte(body))
+	if len(a.Comment) != 0 {
+		a.Files = append(a.Files, txtar.File{Name: name, Data: a.Comment})
+		a.Comment = nil
+	}
+	for _, f := range a.Files {
+		path, err := archivePath(dir, f.Name)
+		if err != nil {
+			return false, err
+		}
+		if err := ioutil.WriteFile(path, f.Data, 0666); err != nil {
+			return false, err
+		}
+		if f.Name == "go.mod" {
+			hasModfile = true
+		}
+	}
+	return hasModfile, nil
+}
+
+// archivePath returns the path in dir of the archive file name, or an error
+// if name is absolute or would be written outside dir.
+func archivePath(dir, name string) (string, error) {
+	if name == "" || filepath.IsAbs(name) {
+		return "", fmt.Errorf("invalid file name %q in archive", name)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(name), "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("invalid file name %q in archive", name)
+		}
+	}
+	path := filepath.Join(dir, name)
+	if rel, err := filepath.Rel(dir, path); err != nil || rel == "." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid file name %q in archive", name)
+	}
+	return path, nil
+}
+
+// build checks the package in path, then runs the go command with args, eg:
+// "build", on it and returns the path of the binary. If cache is set, the
+// binary is moved there once built.
+func (p *process) build(path, cache string, hasModfile bool, args ...string) (string, error) {
+	if err := p.check(path, hasModfile); err != nil {
+		return "", err
+	}
+	p.phase = phaseBuild
+	bin := filepath.Join(path, p.target.exe("prog"))
+	if cache != "" {
+		// Build next to the cache entry, so that it can be renamed into
+		// place even if another run is building the same snippet.
+		bin = cache + "-" + filepath.Base(path)
+	}
+
+	// build x.go, creating x
+	cmd := p.goCmd(path, hasModfile, append(args, "-tags", "OMIT", "-o", bin)...)
+	cmd.Stderr = &diagnosticWriter{p: p, dir: path, source: "compile"}
+	if err := cmd.Run(); err != nil {
+		os.Remove(bin)
+		return "", err
+	}
+	if cache == "" {
+		return bin, nil
+	}
+	if err := os.Rename(bin, cache); err != nil {
+		os.Remove(bin)
+		return "", err
+	}
+	p.goBuild.prune()
+	return cache, nil
+}
+
+// sandbox configures cmd to run in a sandbox if the policy requires it for
+// the run kind. The directories in keep stay visible inside the sandbox.
+func (p *process) sandbox(cmd *exec.Cmd, kind runKind, keep ...string) error {
+	cfg := p.policy.SandboxFor(string(kind))
+	if cfg == nil {
+		return nil
+	}
+	cleanup, err := sandbox.Command(cmd, cfg, keep...)
+	if err != nil {
+		return err
+	}
+	p.cleanup = cleanup
 	return nil
 }
 
 // cmd builds an *exec.Cmd that writes its standard output and error to the
-// process' output channel.
+// process' output channel, and is killed if the process is.
 func (p *process) cmd(dir string, args ...string) *exec.Cmd {
-	cmd := exec.Command(args[0], args[1:]...)
+	cmd := exec.CommandContext(p.ctx, args[0], args[1:]...)
 	cmd.Dir = dir
 	cmd.Env = Environ()
 	cmd.Stdout = &messageWriter{kind: "stdout", out: p.out}
@@ -519,6 +1012,17 @@ func (p *process) cmd(dir string, args ...string) *exec.Cmd {
 	return cmd
 }
 
+// buildCmd is like cmd, but for the steps before the run, such as builds,
+// whose children are killed along with them.
+func (p *process) buildCmd(dir string, args ...string) *exec.Cmd {
+	cmd := p.cmd(dir, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd
+}
+
 func packageName(body string) (string, error) {
 	f, err := parser.ParseFile(token.NewFileSet(), "prog.go",
 		strings.NewReader(body), parser.PackageClauseOnly)
@@ -533,10 +1037,11 @@ func packageName(body string) (string, error) {
 type messageWriter struct {
 	kind string
 	out  chan<- *Message
+	tty  bool // writing terminal output
 }
 
 func (w *messageWriter) Write(b []byte) (n int, err error) {
-	w.out <- &Message{Kind: w.kind, Body: safeString(b)}
+	w.out <- &Message{Kind: w.kind, Body: safeString(b), tty: w.tty}
 	return len(b), nil
 }
 
@@ -5,21 +5,32 @@
 package socket
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/rquitales/go-presentation-server/pkg/sandbox"
 )
 
+func TestMain(m *testing.M) {
+	// The test binary is re-executed as the sandbox init.
+	sandbox.Init()
+	os.Exit(m.Run())
+}
+
 func TestBuffer(t *testing.T) {
 	afterChan := make(chan time.Time)
 	ch := make(chan *Message)
 	go func() {
-		ch <- &Message{Kind: "err", Body: "a"}
-		ch <- &Message{Kind: "err", Body: "b"}
-		ch <- &Message{Kind: "out", Body: "1"}
-		ch <- &Message{Kind: "out", Body: "2"}
+		ch <- &Message{Kind: "err", Body: "a", Time: 1}
+		ch <- &Message{Kind: "err", Body: "b", Time: 2}
+		ch <- &Message{Kind: "out", Body: "1", Time: 3}
+		ch <- &Message{Kind: "out", Body: "2", Time: 4}
 		afterChan <- time.Time{} // value itself doesn't matter
-		ch <- &Message{Kind: "out", Body: "3"}
-		ch <- &Message{Kind: "out", Body: "4"}
+		ch <- &Message{Kind: "out", Body: "3", Time: 5}
+		ch <- &Message{Kind: "out", Body: "4", Time: 6}
 		close(ch)
 	}()
 
@@ -42,6 +53,12 @@ func TestBuffer(t *testing.T) {
 	if g, w := ms[2].Body, "34"; g != w {
 		t.Errorf("message 2 body = %q, want %q", g, w)
 	}
+	// Coalesced messages keep the time of their first part.
+	for i, w := range []int64{1, 3, 5} {
+		if g := ms[i].Time; g != w {
+			t.Errorf("message %d time = %d, want %d", i, g, w)
+		}
+	}
 }
 
 type killRecorder chan struct{}
@@ -75,3 +92,44 @@ func TestLimiter(t *testing.T) {
 		t.Errorf("process wasn't killed after reaching limit")
 	}
 }
+
+func TestWriteArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string // files written
+		wantErr bool
+	}{
+		{"Comment", "package main\n", []string{"prog.go"}, false},
+		{"Files", "package main\n-- go.mod --\nmodule m\n-- util.go --\npackage main\n", []string{"go.mod", "prog.go", "util.go"}, false},
+		{"Dot in name", "-- ./util.go --\npackage main\n", []string{"util.go"}, false},
+		{"Parent directory", "-- ../../x --\nx\n", nil, true},
+		{"Parent directory within name", "-- a/../../x --\nx\n", nil, true},
+		{"Absolute", "-- /tmp/x --\nx\n", nil, true},
+		{"Directory itself", "-- . --\nx\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "dir")
+			if err := os.Mkdir(dir, 0777); err != nil {
+				t.Fatal(err)
+			}
+			_, err := writeArchive(dir, tt.body, "prog.go")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("writeArchive() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					rel, _ := filepath.Rel(dir, path)
+					got = append(got, rel)
+				}
+				return err
+			})
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"errors"
+	"io"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+// The number of "stdin" messages queued for a process before further ones
+// are dropped, as the process isn't reading them.
+const stdinBuffer = 64
+
+var errStdinFull = errors.New("standard input is full, the process is not reading it")
+
+// openStdin connects the standard input of cmd to the "stdin" messages
+// queued for the process in input. It must be called before cmd is started.
+func (p *process) openStdin(cmd *exec.Cmd, input <-chan string) error {
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	go copyInput(w, input, p.done)
+	return nil
+}
+
+// copyInput writes the queued input to w in order, closing w once input is
+// closed. It stops without closing w once the process is done, as w may be
+// the standard input of a session, which outlives the process.
+func copyInput(w io.WriteCloser, input <-chan string, done <-chan struct{}) {
+	for {
+		select {
+		case s, ok := <-input:
+			if !ok {
+				w.Close()
+				return
+			}
+			if _, err := io.WriteString(w, s); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// write queues s to be written to the standard input of the process. It
+// does nothing if the process doesn't read its standard input, or has
+// closed it, and drops s if too much input is already queued, so as never
+// to block. Like closeStdin, it is only called by the socket handler.
+func (p *process) write(s string) error {
+	if p == nil || p.input == nil {
+		return nil
+	}
+	select {
+	case p.input <- s:
+	case <-p.done:
+	default:
+		return errStdinFull
+	}
+	return nil
+}
+
+// closeStdin closes the standard input of the process once the queued
+// input has been written.
+func (p *process) closeStdin() {
+	if p == nil || p.input == nil {
+		return
+	}
+	close(p.input)
+	p.input = nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// receiveUntilEnd collects the stdout of process id until its end message.
+func receiveUntilEnd(t *testing.T, ws *websocket.Conn, id string) (stdout string, end *Message) {
+	t.Helper()
+	ws.SetDeadline(time.Now().Add(10 * time.Second))
+	var out strings.Builder
+	var seq uint64
+	for {
+		var m Message
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		if m.Id != id {
+			continue
+		}
+		if m.Seq <= seq || m.Time == 0 {
+			t.Fatalf("got %+v after Seq %d, want a later timestamped one", m, seq)
+		}
+		seq = m.Seq
+		switch m.Kind {
+		case "stdout":
+			out.WriteString(m.Body)
+		case "end":
+			return out.String(), &m
+		}
+	}
+}
+
+func TestStdin(t *testing.T) {
+	dial, cleanup := newTestServer(t)
+	defer cleanup()
+	ws, err := dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	// A script prompting for input.
+	websocket.JSON.Send(ws, &Message{Id: "read", Kind: "run", Body: "#!/bin/sh\necho 'name?'\nread name\necho \"hello $name\""})
+	websocket.JSON.Send(ws, &Message{Id: "read", Kind: "stdin", Body: "gopher\n"})
+	if out, end := receiveUntilEnd(t, ws, "read"); out != "name?\nhello gopher\n" || end.Body != "" {
+		t.Errorf("read: got stdout %q, end %q", out, end.Body)
+	}
+
+	// A program reading until the end of its input.
+	websocket.JSON.Send(ws, &Message{Id: "cat", Kind: "run", Body: "#!/bin/sh\ncat\necho done"})
+	websocket.JSON.Send(ws, &Message{Id: "cat", Kind: "stdin", Body: "a\n"})
+	websocket.JSON.Send(ws, &Message{Id: "cat", Kind: "stdin", Body: "b\n"})
+	websocket.JSON.Send(ws, &Message{Id: "cat", Kind: "eof"})
+	if out, end := receiveUntilEnd(t, ws, "cat"); out != "a\nb\ndone\n" || end.Body != "" {
+		t.Errorf("cat: got stdout %q, end %q", out, end.Body)
+	}
+}
+
+func TestStdinFull(t *testing.T) {
+	dial, cleanup := newTestServer(t)
+	defer cleanup()
+	ws, err := dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	// Input for a process which never reads it, more than the pipe and
+	// queue hold, must not stop the process from being killed.
+	websocket.JSON.Send(ws, &Message{Id: "sleep", Kind: "run", Body: "#!/bin/sh\nsleep 600"})
+	line := strings.Repeat("x", 4095) + "\n"
+	for i := 0; i < 2*stdinBuffer; i++ {
+		websocket.JSON.Send(ws, &Message{Id: "sleep", Kind: "stdin", Body: line})
+	}
+	websocket.JSON.Send(ws, &Message{Id: "sleep", Kind: "kill"})
+	if _, end := receiveUntilEnd(t, ws, "sleep"); end.Exit.KilledBy != killedByUser {
+		t.Errorf("got end %q killed by %q, want killed by user", end.Body, end.Exit.KilledBy)
+	}
+}
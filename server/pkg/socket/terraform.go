@@ -16,38 +16,17 @@ package socket
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-	"time"
 
-	"golang.org/x/tools/txtar"
+	"github.com/rquitales/go-presentation-server/pkg/policy"
 )
 
 // startKubectl saves a yaml file and runs the specified kubectl action on the yaml file,
 // sending its output and end event as Messages on the provided channel.
-func startTerraform(id, action, body string, dest chan<- *Message, opt *Options) *process {
-	var (
-		done = make(chan struct{})
-		out  = make(chan *Message)
-		p    = &process{out: out, done: done}
-	)
-	go func() {
-		defer close(done)
-		for m := range buffer(limiter(out, p), time.After) {
-			m.Id = id
-			dest <- m
-		}
-	}()
-
-	err := p.startTerraform(id, action, body, opt)
-	if err != nil {
-		p.end(err)
-		return nil
-	}
-	go func() {
-		p.end(p.run.Wait())
-	}()
+func startTerraform(id, action, body string, dest chan<- *Message, opt *Options, pol *policy.Policy) *process {
+	p := newProcess(id, terraform, dest, opt, pol)
+	p.background(opt, func() error { return p.startTerraform(id, action, body, opt) })
 	return p
 }
 
@@ -76,23 +55,17 @@ func (p *process) startTerraform(id, action, body string, opt *Options) error {
 
 	if !(action == "destroy") {
 		// write body to x.tf files
-		a := txtar.Parse([]byte(body))
-		if len(a.Comment) != 0 {
-			a.Files = append(a.Files, txtar.File{Name: "main.tf", Data: a.Comment})
-			a.Comment = nil
-		}
-		for _, f := range a.Files {
-			err = ioutil.WriteFile(filepath.Join(tfPath, f.Name), f.Data, 0666)
-			if err != nil {
-				return err
-			}
+		if _, err := writeArchive(tfPath, body, "main.tf"); err != nil {
+			return err
 		}
 
+		p.phase = phaseInit
 		args := []string{"terraform", "init"}
-		cmd := p.cmd(tfPath, args...)
+		cmd := p.buildCmd(tfPath, args...)
 		if err := cmd.Run(); err != nil {
 			return fmt.Errorf("unable to init terraform: %w", err)
 		}
+		p.phase = phaseRun
 	}
 	// auto-approve flag required as cmds run non-interractively.
 	args := []string{"terraform", action, "-auto-approve"}
@@ -103,6 +76,5 @@ func (p *process) startTerraform(id, action, body string, opt *Options) error {
 		return err
 	}
 	p.run = cmd
-	p.kind = kubectl
 	return nil
 }
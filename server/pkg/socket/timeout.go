@@ -0,0 +1,164 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+// defaultTimeouts are the wall-clock timeouts for each run kind, used when
+// neither the policy nor the message sets one.
+var defaultTimeouts = map[runKind]time.Duration{
+	shell:     10 * time.Minute,
+	golang:    2 * time.Minute,
+	kubectl:   5 * time.Minute,
+	terraform: 30 * time.Minute,
+}
+
+// validate checks that the options are well formed.
+func (o *Options) validate() error {
+	if o == nil {
+		return nil
+	}
+	for name, v := range map[string]string{"Timeout": o.Timeout, "CPUTimeout": o.CPUTimeout, "Wait": o.Wait} {
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s %q: want a positive duration such as \"30s\"", name, v)
+		}
+	}
+	return nil
+}
+
+// timeouts returns the wall-clock and CPU time limits for the process. The
+// policy overrides the defaults, and the options may shorten, but not
+// extend, the limits either sets. Unless the options set the timeout, it is
+// extended by how long kubectl runs wait for the objects applied to become
+// ready.
+func (p *process) timeouts(opt *Options) (wall, cpu time.Duration) {
+	t := p.policy.TimeoutFor(string(p.kind))
+	wall, cpu = defaultTimeouts[p.kind], time.Duration(t.CPU)
+	if t.Wall > 0 {
+		wall = time.Duration(t.Wall)
+	}
+	if opt != nil {
+		// Already validated.
+		if d, err := time.ParseDuration(opt.Timeout); err == nil {
+			wall = shorter(wall, d)
+		} else if d, err := time.ParseDuration(opt.Wait); err == nil && p.kind == kubectl && wall > 0 {
+			wall += d
+		}
+		if d, err := time.ParseDuration(opt.CPUTimeout); err == nil {
+			cpu = shorter(cpu, d)
+		}
+	}
+	return wall, cpu
+}
+
+// shorter returns the shorter of the limits a and b, where 0 means there is
+// no limit.
+func shorter(a, b time.Duration) time.Duration {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// limit kills the process once it runs longer than its wall-clock timeout,
+// counted from when it was received, so that builds count towards it.
+func (p *process) limit(opt *Options) {
+	wall, _ := p.timeouts(opt)
+	if wall <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timer = time.AfterFunc(wall, func() {
+		p.killFor(killedByTimeout, fmt.Sprintf("timeout after %v", wall))
+	})
+}
+
+// limitCPU has the kernel kill the process once it exceeds its CPU time
+// limit. Session runs don't get one: their shell outlives them, and its CPU
+// time adds up across runs.
+func (p *process) limitCPU(opt *Options) {
+	_, cpu := p.timeouts(opt)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cpu > 0 && p.run != nil && !p.sessionRun {
+		if err := setCPULimit(p.run.Process.Pid, cpu); err != nil {
+			log.Println("unable to set cpu limit:", err)
+			return
+		}
+		p.cpu = cpu
+	}
+}
+
+// killFor kills the process, recording who killed it and why. The reason
+// may be empty.
+func (p *process) killFor(by, reason string) {
+	p.mu.Lock()
+	if p.killedBy == "" {
+		p.killedBy, p.killed = by, reason
+	}
+	p.mu.Unlock()
+	p.Kill()
+}
+
+// killInfo stops the timeout and returns who killed the process and why
+// given its exit error, or "" if it wasn't killed.
+func (p *process) killInfo(err error) (by, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	if p.killed != "" {
+		return p.killedBy, p.killed
+	}
+	if p.cpu > 0 && cpuExceeded(err, p.cpu) {
+		return killedByTimeout, fmt.Sprintf("cpu limit of %v exceeded", p.cpu)
+	}
+	return p.killedBy, ""
+}
+
+// cpuExceeded reports whether err shows the process, or for shells its last
+// command, was killed by the kernel for exceeding the CPU limit. The kernel
+// sends SIGXCPU at the limit, then SIGKILL if that is ignored.
+func cpuExceeded(err error, limit time.Duration) bool {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return false
+	}
+	ws, ok := ee.Sys().(syscall.WaitStatus)
+	switch {
+	case !ok:
+		return false
+	case ws.Signaled():
+		return ws.Signal() == syscall.SIGXCPU ||
+			(ws.Signal() == syscall.SIGKILL && ee.UserTime()+ee.SystemTime() >= limit)
+	case ws.Exited():
+		return ws.ExitStatus() == 128+int(syscall.SIGXCPU)
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/rquitales/go-presentation-server/pkg/policy"
+)
+
+// runToEnd starts a shell snippet and returns its "end" message.
+func runToEnd(t *testing.T, body string, opt *Options, pol *policy.Policy) *Message {
+	t.Helper()
+	dest := make(chan *Message)
+	startProcess("t", body, dest, opt, "", pol, nil)
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case m := <-dest:
+			if m.Kind == "end" {
+				return m
+			}
+		case <-timeout:
+			t.Fatal("process did not end")
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	pol, err := policy.Parse([]byte("timeouts:\n  shell: {wall: 300ms}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		opt  *Options
+		want string
+	}{
+		{"Normal exit", "#!/bin/sh\nexit 0", nil, ""},
+		{"Exit code", "#!/bin/sh\nexit 3", nil, "exit status 3"},
+		{"Policy timeout", "#!/bin/sh\nsleep 5", nil, "killed: timeout after 300ms"},
+		{"Options timeout", "#!/bin/sh\nsleep 5", &Options{Timeout: "100ms"}, "killed: timeout after 100ms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if m := runToEnd(t, tt.body, tt.opt, pol); m.Body != tt.want {
+				t.Errorf("end body = %q, want %q", m.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildTimeout(t *testing.T) {
+	// A go command whose builds hang, along with a child of theirs.
+	dir := t.TempDir()
+	fake := "#!/bin/sh\ncase $1 in vet) exit 0;; esac\nsleep 10 &\nwait\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "go"), []byte(fake), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+	dest := make(chan *Message)
+	start := time.Now()
+	p := startProcess("t", "package main\n\nfunc main() {}\n", dest, &Options{Timeout: "500ms"}, "", nil, nil)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("startProcess took %v, want the build not to hold up the handler", d)
+	}
+	if p == nil {
+		t.Fatal("startProcess() = nil")
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m := <-dest:
+			if m.Kind != "end" {
+				continue
+			}
+			if want := "killed: timeout after 500ms"; m.Body != want || m.Exit.Phase != phaseBuild || m.Exit.KilledBy != killedByTimeout {
+				t.Errorf("end body = %q, exit %+v; want %q in the build phase", m.Body, m.Exit, want)
+			}
+			return
+		case <-timeout:
+			t.Fatal("build was not killed")
+		}
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	pol, err := policy.Parse([]byte("timeouts:\n  kubectl: {wall: 1m}\n  shell: {cpu: 10s}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		kind    runKind
+		pol     *policy.Policy
+		opt     *Options
+		want    time.Duration
+		wantCPU time.Duration
+	}{
+		{"Default", kubectl, nil, nil, 5 * time.Minute, 0},
+		{"Policy", kubectl, pol, nil, time.Minute, 0},
+		{"Options", kubectl, pol, &Options{Timeout: "30s"}, 30 * time.Second, 0},
+		{"Options over policy", kubectl, pol, &Options{Timeout: "1h"}, time.Minute, 0},
+		{"Options over default", golang, nil, &Options{Timeout: "1h"}, 2 * time.Minute, 0},
+		{"Options without limit", stream, nil, &Options{Timeout: "1h"}, time.Hour, 0},
+		{"Wait", kubectl, nil, &Options{Wait: "10m"}, 15 * time.Minute, 0},
+		{"Wait with policy", kubectl, pol, &Options{Wait: "10m"}, 11 * time.Minute, 0},
+		{"Wait with options", kubectl, pol, &Options{Timeout: "2m", Wait: "10m"}, time.Minute, 0},
+		{"Stream", stream, nil, &Options{Wait: "10m"}, 0, 0},
+		{"CPU policy", shell, pol, nil, 10 * time.Minute, 10 * time.Second},
+		{"CPU options", shell, pol, &Options{CPUTimeout: "5s"}, 10 * time.Minute, 5 * time.Second},
+		{"CPU options over policy", shell, pol, &Options{CPUTimeout: "1m"}, 10 * time.Minute, 10 * time.Second},
+		{"CPU options without limit", shell, nil, &Options{CPUTimeout: "1m"}, 10 * time.Minute, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &process{kind: tt.kind, policy: tt.pol}
+			if wall, cpu := p.timeouts(tt.opt); wall != tt.want || cpu != tt.wantCPU {
+				t.Errorf("timeouts() = %v, %v, want %v, %v", wall, cpu, tt.want, tt.wantCPU)
+			}
+		})
+	}
+}
+
+func TestCPUTimeout(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("cpu limits are only supported on linux")
+	}
+	m := runToEnd(t, "#!/bin/sh\nwhile :; do :; done", &Options{CPUTimeout: "1s"}, nil)
+	if want := "killed: cpu limit of 1s exceeded"; m.Body != want {
+		t.Errorf("end body = %q, want %q", m.Body, want)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		opt     *Options
+		wantErr bool
+	}{
+		{nil, false},
+		{&Options{}, false},
+		{&Options{Timeout: "30s", CPUTimeout: "5s"}, false},
+		{&Options{Timeout: "30"}, true},
+		{&Options{CPUTimeout: "-1s"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.opt.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) error = %v, wantErr %v", tt.opt, err, tt.wantErr)
+		}
+	}
+}
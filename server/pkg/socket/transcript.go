@@ -0,0 +1,362 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TranscriptPath is the URL path that transcripts are served under.
+const TranscriptPath = "/transcript/"
+
+const (
+	// The number of transcripts kept, dropping the oldest ones.
+	maxTranscripts = 100
+	// The number of messages kept per transcript.
+	maxTranscriptMessages = 10000
+)
+
+// Transcripts keeps a transcript of the commands sent by each presenter
+// connection and the output of the processes they ran, and serves them as
+// asciinema v2 recordings or Markdown documents.
+type Transcripts struct {
+	mu   sync.Mutex
+	next int
+	list []*transcript // oldest first
+}
+
+// NewTranscripts returns an empty set of transcripts.
+func NewTranscripts() *Transcripts {
+	return &Transcripts{next: 1}
+}
+
+// transcript is the messages sent on a connection, in order.
+type transcript struct {
+	id      int
+	remote  string
+	started time.Time
+
+	mu        sync.Mutex
+	entries   []transcriptEntry
+	truncated bool
+}
+
+// transcriptEntry is a message sent on a connection, and when it was sent.
+type transcriptEntry struct {
+	time time.Duration // since the connection was opened
+	in   bool          // sent by the presenter, rather than the server
+	m    Message
+}
+
+// start starts the transcript of a connection from remote.
+func (ts *Transcripts) start(remote string) *transcript {
+	if ts == nil {
+		return nil
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t := &transcript{id: ts.next, remote: remote, started: time.Now()}
+	ts.next++
+	ts.list = append(ts.list, t)
+	if len(ts.list) > maxTranscripts {
+		ts.list = ts.list[1:]
+	}
+	return t
+}
+
+// get returns the transcript with the given id, or nil.
+func (ts *Transcripts) get(id int) *transcript {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, t := range ts.list {
+		if t.id == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// add adds a message to the transcript. Only the output and end of
+// processes are kept of the messages sent by the server.
+func (t *transcript) add(m *Message, in bool) {
+	if t == nil {
+		return
+	}
+	if !in {
+		switch m.Kind {
+		case "stdout", "stderr", "kubectlResult", "kubectlStatus", "watchEvent", "log", "end":
+		default:
+			return
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.entries) >= maxTranscriptMessages {
+		t.truncated = true
+		return
+	}
+	t.entries = append(t.entries, transcriptEntry{time: time.Since(t.started), in: in, m: *m})
+}
+
+// snapshot returns the entries so far.
+func (t *transcript) snapshot() (entries []transcriptEntry, truncated bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]transcriptEntry(nil), t.entries...), t.truncated
+}
+
+// transcriptInfo describes a transcript in the list served by Transcripts.
+type transcriptInfo struct {
+	Id       int
+	Remote   string
+	Started  time.Time
+	Messages int
+	Cast     string // URL paths of the exported transcript
+	Markdown string
+}
+
+// ServeHTTP serves the list of transcripts as JSON for an empty path, and
+// exports a transcript for a path such as "1.cast" or "1.md". The request
+// path must have TranscriptPath stripped.
+func (ts *Transcripts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" {
+		ts.mu.Lock()
+		list := make([]transcriptInfo, len(ts.list))
+		for i, t := range ts.list {
+			entries, _ := t.snapshot()
+			name := TranscriptPath + strconv.Itoa(t.id)
+			list[i] = transcriptInfo{Id: t.id, Remote: t.remote, Started: t.started, Messages: len(entries), Cast: name + ".cast", Markdown: name + ".md"}
+		}
+		ts.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	ext := filepath.Ext(r.URL.Path)
+	id, err := strconv.Atoi(strings.TrimSuffix(r.URL.Path, ext))
+	t := ts.get(id)
+	if err != nil || t == nil || (ext != ".cast" && ext != ".md") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"transcript-%d%s\"", id, ext))
+	if ext == ".cast" {
+		w.Header().Set("Content-Type", "application/x-asciicast")
+		err = t.cast(bufio.NewWriter(w))
+	} else {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		err = t.markdown(bufio.NewWriter(w))
+	}
+	if err != nil {
+		log.Printf("unable to export transcript %d: %v", id, err)
+	}
+}
+
+// Terminal escape sequences used in asciinema recordings.
+const (
+	ansiDim   = "\x1b[2m"
+	ansiRed   = "\x1b[31m"
+	ansiReset = "\x1b[0m"
+)
+
+// cast writes the transcript as an asciinema v2 recording, see
+// https://docs.asciinema.org/manual/asciicast/v2/. Commands are shown as
+// comments followed by the snippet that was run, and stderr in red.
+func (t *transcript) cast(w *bufio.Writer) error {
+	entries, truncated := t.snapshot()
+	width, height := 80, 24
+	for _, e := range entries {
+		if o := e.m.Options; e.in && o != nil && o.Cols > 0 && o.Rows > 0 {
+			width, height = int(o.Cols), int(o.Rows)
+			break
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.Encode(map[string]interface{}{
+		"version":   2,
+		"width":     width,
+		"height":    height,
+		"timestamp": t.started.Unix(),
+		"title":     fmt.Sprintf("present transcript %d", t.id),
+	})
+	event := func(d time.Duration, code, data string) {
+		enc.Encode([]interface{}{d.Seconds(), code, data})
+	}
+
+	var last time.Duration
+	for _, e := range entries {
+		last = e.time
+		m := e.m
+		switch {
+		case e.in && m.Kind == "stdin":
+			event(e.time, "i", m.Body)
+		case e.in && m.Kind == "resize":
+			if m.Options != nil {
+				event(e.time, "r", fmt.Sprintf("%dx%d", m.Options.Cols, m.Options.Rows))
+			}
+		case e.in && !controlKind(m.Kind):
+			s := ansiDim + "# " + commandTitle(&m) + ansiReset + "\n" + m.Body
+			if !strings.HasSuffix(s, "\n") {
+				s += "\n"
+			}
+			event(e.time, "o", crlf(s))
+		case m.Kind == "stdout" || m.Kind == "kubectlResult" || m.Kind == "kubectlStatus" || m.Kind == "watchEvent" || m.Kind == "log":
+			event(e.time, "o", crlf(m.Body))
+		case m.Kind == "stderr":
+			event(e.time, "o", ansiRed+crlf(m.Body)+ansiReset)
+		case m.Kind == "end" && m.Body != "":
+			event(e.time, "o", ansiDim+"["+m.Body+"]"+ansiReset+"\r\n")
+		}
+	}
+	if truncated {
+		event(last, "o", ansiDim+"[transcript truncated]"+ansiReset+"\r\n")
+	}
+	return w.Flush()
+}
+
+// crlf returns s with line endings suitable for a terminal.
+func crlf(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
+
+// commandTitle describes the command m, eg: "run demo".
+func commandTitle(m *Message) string {
+	s := m.Kind
+	if m.Id != "" {
+		s += " " + m.Id
+	}
+	if m.Path != "" {
+		s += " " + m.Path
+	}
+	return s
+}
+
+// transcriptSection is a command and its output in a Markdown transcript.
+type transcriptSection struct {
+	m      Message
+	at     time.Duration
+	output strings.Builder
+	end    *Message
+}
+
+// markdown writes the transcript as a Markdown document, with a section
+// for each command holding the snippet run and its output.
+func (t *transcript) markdown(w *bufio.Writer) error {
+	entries, truncated := t.snapshot()
+	var sections []*transcriptSection
+	current := make(map[string]*transcriptSection) // by Id
+	for _, e := range entries {
+		m := e.m
+		switch {
+		case e.in && !controlKind(m.Kind):
+			s := &transcriptSection{m: m, at: e.time}
+			sections = append(sections, s)
+			current[m.Id] = s
+		case !e.in && current[m.Id] != nil:
+			s := current[m.Id]
+			if m.Kind == "end" {
+				s.end = &e.m
+				delete(current, m.Id)
+				break
+			}
+			s.output.WriteString(m.Body)
+		}
+	}
+
+	fmt.Fprintf(w, "# Transcript %d\n\nPresented from %s on %s.\n", t.id, t.remote, t.started.Format(time.RFC1123))
+	for _, s := range sections {
+		title := s.m.Kind
+		for _, name := range []string{s.m.Id, s.m.Path} {
+			if name != "" {
+				title += " `" + name + "`"
+			}
+		}
+		fmt.Fprintf(w, "\n## %s (at %s)\n\n", title, s.at.Round(time.Second))
+		writeFenced(w, snippetLanguage(&s.m), s.m.Body)
+		if out := plainText(s.output.String()); out != "" {
+			fmt.Fprintf(w, "\nOutput:\n\n")
+			writeFenced(w, "text", out)
+		}
+		switch {
+		case s.end == nil:
+			fmt.Fprintf(w, "\n_Did not end._\n")
+		case s.end.Body != "":
+			fmt.Fprintf(w, "\n> %s\n", s.end.Body)
+		}
+	}
+	if truncated {
+		fmt.Fprintf(w, "\n_The transcript was truncated._\n")
+	}
+	return w.Flush()
+}
+
+// writeFenced writes s as a fenced code block, using a fence longer than
+// any run of backticks in s.
+func writeFenced(w io.Writer, lang, s string) {
+	fence := "```"
+	for strings.Contains(s, fence) {
+		fence += "`"
+	}
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	fmt.Fprintf(w, "%s%s\n%s%s\n", fence, lang, s, fence)
+}
+
+// snippetLanguage returns the Markdown code block language of the snippet
+// run by m.
+func snippetLanguage(m *Message) string {
+	switch {
+	case strings.HasPrefix(m.Kind, "kubectl"), m.Kind == "watch":
+		return "yaml"
+	case m.Kind == "logs":
+		return "text"
+	case strings.HasPrefix(m.Kind, "terraform"):
+		return "hcl"
+	case m.Kind == "saveFile":
+		return strings.TrimPrefix(filepath.Ext(m.Path), ".")
+	}
+	if path, args := shebang(m.Body); path != "" {
+		if isShell(path, args) {
+			return "sh"
+		}
+		if filepath.Base(path) == "env" && len(args) > 1 {
+			path = args[1]
+		}
+		return filepath.Base(path)
+	}
+	return "go"
+}
+
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+
+// plainText returns terminal output without escape sequences or carriage
+// returns.
+func plainText(s string) string {
+	s = ansiEscape.ReplaceAllString(s, "")
+	return strings.ReplaceAll(s, "\r\n", "\n")
+}
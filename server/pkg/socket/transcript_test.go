@@ -0,0 +1,132 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestTranscript(t *testing.T) {
+	ts := NewTranscripts()
+	dial, cleanup := newTestServerConfig(t, Config{Transcripts: ts})
+	defer cleanup()
+	ws, err := dial("token=" + testToken)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	websocket.JSON.Send(ws, &Message{Id: "demo", Kind: "run", Body: "#!/bin/sh\necho hello\necho oops >&2\necho '```'\nexit 1"})
+	receiveUntilEnd(t, ws, "demo")
+
+	// The end message is added once it has been sent.
+	export := func(path string) string {
+		rec := httptest.NewRecorder()
+		http.StripPrefix(TranscriptPath, ts).ServeHTTP(rec, httptest.NewRequest("GET", TranscriptPath+path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: got status %d", path, rec.Code)
+		}
+		return rec.Body.String()
+	}
+	for i := 0; i < 100 && !strings.Contains(export("1.md"), "exit status 1"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Run("List", func(t *testing.T) {
+		var list []transcriptInfo
+		if err := json.Unmarshal([]byte(export("")), &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].Id != 1 || list[0].Cast != "/transcript/1.cast" {
+			t.Errorf("got transcripts %+v, want transcript 1", list)
+		}
+	})
+
+	t.Run("Cast", func(t *testing.T) {
+		s := bufio.NewScanner(strings.NewReader(export("1.cast")))
+		s.Scan()
+		var header struct{ Version, Width, Height int }
+		if err := json.Unmarshal(s.Bytes(), &header); err != nil || header.Version != 2 || header.Width != 80 {
+			t.Fatalf("got header %s, want version 2 of width 80", s.Bytes())
+		}
+		var output string
+		for s.Scan() {
+			var e []interface{}
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil || len(e) != 3 {
+				t.Fatalf("invalid event %s", s.Bytes())
+			}
+			if e[1] == "o" {
+				output += e[2].(string)
+			}
+		}
+		for _, want := range []string{"# run demo", "hello\r\n", ansiRed + "oops\r\n" + ansiReset, "[exit status 1]"} {
+			if !strings.Contains(output, want) {
+				t.Errorf("cast output %q does not contain %q", output, want)
+			}
+		}
+	})
+
+	t.Run("Markdown", func(t *testing.T) {
+		md := export("1.md")
+		for _, want := range []string{"## run `demo`", "````sh\n#!/bin/sh\n", "````text\n", "hello\n", "oops\n", "```\n", "> exit status 1"} {
+			if !strings.Contains(md, want) {
+				t.Errorf("markdown %q does not contain %q", md, want)
+			}
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		for _, path := range []string{"2.md", "1.txt", "x.cast"} {
+			rec := httptest.NewRecorder()
+			http.StripPrefix(TranscriptPath, ts).ServeHTTP(rec, httptest.NewRequest("GET", TranscriptPath+path, nil))
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("GET %s: got status %d, want 404", path, rec.Code)
+			}
+		}
+	})
+}
+
+func TestSnippetLanguage(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *Message
+		want string
+	}{
+		{"Go", &Message{Kind: "run", Body: "package main\n"}, "go"},
+		{"Shell", &Message{Kind: "run", Body: "#!/bin/bash\necho hi\n"}, "sh"},
+		{"Interpreter", &Message{Kind: "run", Body: "#!/usr/bin/env python3\nprint(1)\n"}, "python3"},
+		{"Test", &Message{Kind: "test", Body: "package main\n"}, "go"},
+		{"Kubectl", &Message{Kind: "kubectlApply", Body: "kind: Pod\n"}, "yaml"},
+		{"Terraform", &Message{Kind: "terraformApply"}, "hcl"},
+		{"Save file", &Message{Kind: "saveFile", Path: "config.json"}, "json"},
+		{"Watch", &Message{Kind: "watch", Options: &Options{Kind: "Pod"}}, "yaml"},
+		{"Logs", &Message{Kind: "logs", Options: &Options{Selector: "app=web"}}, "text"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := snippetLanguage(tt.m); got != tt.want {
+				t.Errorf("snippetLanguage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rquitales/go-presentation-server/pkg/k8s"
+	"github.com/rquitales/go-presentation-server/pkg/policy"
+)
+
+// startWatch watches the Kubernetes objects selected by the options,
+// sending a "watchEvent" message as each is added, changed or deleted, until
+// the process is killed.
+func startWatch(id string, dest chan<- *Message, opt *Options, pol *policy.Policy, kc *k8s.Client) *process {
+	p := newProcess(id, stream, dest, opt, pol)
+
+	err := p.startWatch(opt, kc)
+	if err != nil {
+		p.end(err)
+		return nil
+	}
+	p.wait(opt)
+	return p
+}
+
+// startWatch starts watching the objects, sending their changes to p.out.
+func (p *process) startWatch(opt *Options, kc *k8s.Client) error {
+	if kc == nil {
+		return errNoCluster
+	}
+	if opt == nil {
+		opt = &Options{}
+	}
+	q := k8s.Query{APIVersion: opt.APIVersion, Kind: opt.Kind, Namespace: opt.Namespace, Selector: opt.Selector}
+	p.result = make(chan error, 1)
+	go func() {
+		p.result <- stopped(kc.Watch(p.ctx, q, func(e *k8s.Event) {
+			p.out <- &Message{Kind: "watchEvent", Body: e.String() + "\n", Event: e}
+		}))
+	}()
+	return nil
+}
+
+// stopped returns the result of a stream, which only ends without error
+// once canceled by a kill. The end message then reports who killed it,
+// like it does for the signal that kills other processes.
+func stopped(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
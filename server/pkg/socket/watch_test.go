@@ -0,0 +1,72 @@
+// Copyright 2021 Ramon Quitales
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"testing"
+
+	"github.com/rquitales/go-presentation-server/pkg/k8s"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func TestWatch(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	cm := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "a", "namespace": "default"},
+	}}
+	kc := k8s.NewClient(fake.NewSimpleDynamicClient(runtime.NewScheme(), cm), nil, mapper, "default")
+
+	tests := []struct {
+		name       string
+		opt        *Options
+		client     *k8s.Client
+		wantEvents int // before the process is killed
+		wantEnd    string
+		wantBy     string
+	}{
+		{"Killed", &Options{APIVersion: "v1", Kind: "ConfigMap"}, kc, 1, "", killedByUser},
+		{"Missing kind", nil, kc, 0, "an apiVersion and kind to watch are needed", ""},
+		{"No cluster", &Options{APIVersion: "v1", Kind: "ConfigMap"}, nil, 0, errNoCluster.Error(), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := make(chan *Message, 10)
+			p := startWatch("w", dest, tt.opt, nil, tt.client)
+			for i := 0; i < tt.wantEvents; i++ {
+				if m := <-dest; m.Kind != "watchEvent" || m.Event.Type != "ADDED" || m.Event.Name != "a" {
+					t.Fatalf("got %+v, want an ADDED watchEvent for a", m)
+				}
+			}
+			if tt.wantBy != "" {
+				// Watches run until killed.
+				go p.Kill()
+			}
+			m := <-dest
+			if m.Kind != "end" || m.Body != tt.wantEnd {
+				t.Fatalf("got %s %q, want end %q", m.Kind, m.Body, tt.wantEnd)
+			}
+			if m.Exit.KilledBy != tt.wantBy {
+				t.Errorf("got end killed by %q, want %q", m.Exit.KilledBy, tt.wantBy)
+			}
+		})
+	}
+}